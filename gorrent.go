@@ -1,30 +1,50 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/TheLinker/gorrent/libgorrent"
 )
 
 func main() {
-	err := os.Remove("session.gob")
-	if err != nil {
-		log.Println(err.Error())
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Args[2:]))
 	}
 
+	location := flag.String("d", "", "Directory where the torrents are saved")
+	flag.Parse()
+
+	// La sesion anterior trae los torrents y la tabla de la DHT
 	sess, err := libgorrent.NewSessionFromFile("session.gob")
 	if err != nil {
 		log.Println(err.Error())
 		sess, _ = libgorrent.NewSession()
 	}
+
+	if err = sess.Listen(); err != nil {
+		log.Println(err.Error())
+	}
+	if err = sess.StartDHT(); err != nil {
+		log.Println(err.Error())
+	}
+	if err = sess.StartLSD(); err != nil {
+		log.Println(err.Error())
+	}
 	// sess.Debug()
 
 	// log.Println("")
 
-	for argc, argv := range os.Args {
-		if argc == 0 {
+	for _, argv := range flag.Args() {
+		if strings.HasPrefix(argv, "magnet:") {
+			if _, err = sess.AddMagnet(argv, libgorrent.WithLocation(*location)); err != nil {
+				log.Println(err.Error())
+			}
 			continue
 		}
 
@@ -36,25 +56,102 @@ func main() {
 
 		// torrentfile.Debug()
 
-		torrent, err := sess.AddTorrent(torrentfile)
+		torrent, err := sess.AddTorrent(torrentfile, libgorrent.WithLocation(*location))
 		if err != nil {
 			log.Println(err.Error())
-		} else {
-			go torrent.Start()
+			continue
+		}
+
+		// Si ya estan los archivos no los volvemos a bajar, nos quedamos con las piezas que estan bien
+		if torrent.HasData() {
+			bad, err := torrent.Recheck()
+			if err != nil {
+				log.Println(err.Error())
+			} else {
+				log.Printf("%s: %d of %d pieces already downloaded\n", torrentfile.Info.Name, len(torrentfile.Info.Pieces)-len(bad), len(torrentfile.Info.Pieces))
+			}
 		}
 
 		log.Println("")
 	}
 
+	for _, torrent := range sess.AllTorrents {
+		if torrent.Status == libgorrent.Stopped {
+			go torrent.Start()
+		}
+	}
+
+	// Muestro como esta cada swarm sin demorar la descarga, un tracker caido puede tardar bastante
+	go func() {
+		swarms := sess.Scrape()
+		for _, torrent := range sess.AllTorrents {
+			if res, ok := swarms[string(torrent.File.InfoHash)]; ok {
+				log.Printf("%s: %d seeders, %d leechers, %d downloads\n", torrent.File.Info.Name, res.Complete, res.Incomplete, res.Downloaded)
+			}
+		}
+	}()
+
 	err = sess.Save()
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
 
+	// Al salir le avisamos a los trackers
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	ticker := time.NewTicker(5 * time.Second)
 	for {
-		sess.Debug()
-		time.Sleep(5 * time.Second)
+		select {
+		case <-signals:
+			// Guardamos antes de cerrar, con la tabla de la DHT y los torrents todavia activos
+			if err := sess.Save(); err != nil {
+				log.Println(err.Error())
+			}
+			sess.Close()
+			return
+		case <-ticker.C:
+			sess.Debug()
+		}
+	}
+
+}
+
+// verify gorrent verify <torrent> <dir>
+// Verifica los datos que ya estan en dir y muestra las piezas que estan mal
+func verify(args []string) int {
+	if len(args) != 2 {
+		log.Println("Usage: gorrent verify <torrent> <dir>")
+		return 2
 	}
 
+	torrentfile, err := libgorrent.LoadFromFile(args[0])
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	sess, _ := libgorrent.NewSession()
+	torrent, err := sess.AddTorrent(torrentfile, libgorrent.WithLocation(args[1]))
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	bad, err := torrent.Recheck()
+	if err != nil {
+		log.Println(err.Error())
+		return 1
+	}
+
+	for _, index := range bad {
+		log.Printf("Bad piece: %d\n", index)
+	}
+	log.Printf("%d of %d pieces OK\n", len(torrentfile.Info.Pieces)-len(bad), len(torrentfile.Info.Pieces))
+
+	if len(bad) > 0 {
+		return 1
+	}
+	return 0
 }
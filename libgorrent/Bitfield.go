@@ -0,0 +1,80 @@
+package libgorrent
+
+// Bitfield Representa las piezas que tiene un par. El bit mas alto del primer byte es la pieza 0.
+type Bitfield []byte
+
+// NewBitfield Crea un bitfield vacio con lugar para n piezas
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// Has TODO
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]>>(7-uint(index%8))&1 != 0
+}
+
+// Set Marca la pieza. Si el bitfield es chico lo agranda.
+func (b *Bitfield) Set(index int) {
+	if index < 0 {
+		return
+	}
+	for index/8 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[index/8] |= 1 << (7 - uint(index%8))
+}
+
+// Clear TODO
+func (b Bitfield) Clear(index int) {
+	if index < 0 || index/8 >= len(b) {
+		return
+	}
+	b[index/8] &^= 1 << (7 - uint(index%8))
+}
+
+// Count Cantidad de piezas marcadas
+func (b Bitfield) Count() int {
+	n := 0
+	for _, x := range b {
+		for ; x != 0; x &= x - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// Intersect Las piezas que estan en los dos bitfields
+func (b Bitfield) Intersect(o Bitfield) Bitfield {
+	n := len(b)
+	if len(o) < n {
+		n = len(o)
+	}
+	ret := make(Bitfield, n)
+	for i := range ret {
+		ret[i] = b[i] & o[i]
+	}
+	return ret
+}
+
+// valid El bitfield de un torrent de n piezas ocupa (n+7)/8 bytes y los bits que sobran van en 0
+func (b Bitfield) valid(n int) bool {
+	if len(b) != (n+7)/8 {
+		return false
+	}
+	if n%8 != 0 && b[len(b)-1]&(0xff>>uint(n%8)) != 0 {
+		return false
+	}
+	return true
+}
+
+// fullBitfield Un bitfield con las n piezas marcadas
+func fullBitfield(n int) Bitfield {
+	b := NewBitfield(n)
+	for i := 0; i < n; i++ {
+		b.Set(i)
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package libgorrent
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// chokeInterval Cada cuanto se recalcula a quien atendemos
+	chokeInterval = 10 * time.Second
+
+	// optimisticRounds Cada cuantas vueltas del choker se rota el optimistic unchoke (30 segundos)
+	optimisticRounds = 3
+
+	// snubTimeout Si un par que nos dejo pedir no nos manda nada en este tiempo lo consideramos snubbed
+	snubTimeout = 60 * time.Second
+
+	// defaultUploadSlots Cantidad de pares que atendemos a la vez si no se configura otra cosa
+	defaultUploadSlots = 4
+)
+
+// uploadSlots Cantidad de pares a los que les subimos datos a la vez. Torrent.UploadSlots tiene prioridad sobre Session.
+func (t *Torrent) uploadSlots() int {
+	if t.UploadSlots > 0 {
+		return t.UploadSlots
+	}
+	if t.session != nil && t.session.UploadSlots > 0 {
+		return t.session.UploadSlots
+	}
+	return defaultUploadSlots
+}
+
+// choker GoRoutine que implementa tit-for-tat: atendemos a los pares que mas nos dan
+// (o a los que mas rapido nos sacan datos si estamos sembrando) mas un optimistic unchoke que rota.
+func (t *Torrent) choker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	round := 0
+	for t.status() != Stopped {
+		t.rechoke(round%optimisticRounds == 0)
+		round++
+		<-ticker.C
+	}
+}
+
+// rechoke Una vuelta del choker
+func (t *Torrent) rechoke(rotateOptimistic bool) {
+	t.mutexPieces.Lock()
+	seeding := t.Left == 0
+	t.mutexPieces.Unlock()
+
+	t.mutexPeers.RLock()
+	var peers []*Peer
+	for _, p := range t.Peers {
+		if p.status() == PeerConnected {
+			p.updateRates(seeding)
+			peers = append(peers, p)
+		}
+	}
+	t.mutexPeers.RUnlock()
+
+	// Los mejores pares que estan interesados y no nos ignoran
+	var candidates []*Peer
+	for _, p := range peers {
+		if p.PeerInterested && !p.Snubbed {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if seeding {
+			return candidates[i].UploadRate > candidates[j].UploadRate
+		}
+		return candidates[i].DownloadRate > candidates[j].DownloadRate
+	})
+
+	// Un lugar queda reservado para el optimistic unchoke
+	regular := t.uploadSlots() - 1
+	if regular < 0 {
+		regular = 0
+	}
+	if len(candidates) > regular {
+		candidates = candidates[:regular]
+	}
+
+	unchoke := make(map[*Peer]bool)
+	for _, p := range candidates {
+		unchoke[p] = true
+	}
+
+	if t.optimistic != nil && (rotateOptimistic || t.optimistic.status() != PeerConnected || !t.optimistic.PeerInterested) {
+		t.optimistic = nil
+	}
+	if t.optimistic == nil {
+		var choked []*Peer
+		for _, p := range peers {
+			if p.PeerInterested && !unchoke[p] {
+				choked = append(choked, p)
+			}
+		}
+		if len(choked) > 0 {
+			t.optimistic = choked[rand.Intn(len(choked))]
+		}
+	}
+	if t.optimistic != nil {
+		unchoke[t.optimistic] = true
+	}
+
+	for _, p := range peers {
+		if unchoke[p] {
+			p.unchoke()
+		} else {
+			p.choke()
+		}
+	}
+}
+
+// updateRates Calcula las velocidades desde la ultima vuelta del choker y si el par nos esta ignorando
+func (p *Peer) updateRates(seeding bool) {
+	p.umu.Lock()
+	defer p.umu.Unlock()
+
+	secs := int64(chokeInterval / time.Second)
+	p.DownloadRate = (p.Downloaded - p.lastDownloaded) / secs
+	p.UploadRate = (p.Uploaded - p.lastUploaded) / secs
+	p.lastDownloaded = p.Downloaded
+	p.lastUploaded = p.Uploaded
+
+	// Anti-snubbing: si estamos interesados y hace rato que no nos manda nada lo dejamos solo para el optimistic
+	p.Snubbed = !seeding && p.Interested && !p.lastPiece.IsZero() && time.Since(p.lastPiece) > snubTimeout
+}
@@ -0,0 +1,726 @@
+package libgorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const (
+	// dhtAlpha Queries en paralelo durante una busqueda
+	dhtAlpha = 3
+
+	// dhtSecretRotation Cada cuanto cambia el secreto con el que se generan los tokens
+	dhtSecretRotation = 5 * time.Minute
+
+	// dhtPeerTTL Cuanto tiempo guardamos un par que se anuncio con announce_peer
+	dhtPeerTTL = 30 * time.Minute
+
+	// dhtMaxPeersPerHash Cantidad maxima de pares que guardamos por info hash
+	dhtMaxPeersPerHash = 200
+
+	// dhtRefreshInterval Cada cuanto revisamos si hay buckets para refrescar
+	dhtRefreshInterval = time.Minute
+)
+
+// dhtQueryTimeout Cuanto esperamos la respuesta a una query. Es variable para poder achicarlo en tests.
+var dhtQueryTimeout = 5 * time.Second
+
+// defaultDHTBootstrap Nodos conocidos para entrar a la DHT la primera vez
+var defaultDHTBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// DHT Nodo de la Mainline DHT (BEP 5). Sirve para encontrar pares sin tracker.
+type DHT struct {
+	ID []byte
+
+	// OnPeers Se llama con los pares que se encuentran en una busqueda
+	OnPeers func(infoHash []byte, peers []*net.TCPAddr)
+
+	// Privates
+	conn      net.PacketConn
+	bootstrap []string
+	done      chan struct{}
+
+	mutex      sync.Mutex
+	table      *routingTable
+	pending    map[string]*dhtPending
+	tid        uint16
+	secret     []byte
+	prevSecret []byte
+	secretTime time.Time
+	peers      map[string]map[string]time.Time
+}
+
+// dhtLookupNode Un nodo durante una busqueda iterativa
+type dhtLookupNode struct {
+	node    *dhtNode
+	queried bool
+	token   string
+}
+
+// NewDHT Crea un nodo DHT escuchando en addr. Si id es nil se genera uno al azar.
+func NewDHT(addr string, id []byte, bootstrap []string) (*DHT, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.New("Could not listen for DHT on " + addr + ": " + err.Error())
+	}
+	return newDHT(conn, id, bootstrap), nil
+}
+
+// newDHT Crea un nodo DHT sobre conn, que puede ser el socket compartido de la sesion
+func newDHT(conn net.PacketConn, id []byte, bootstrap []string) *DHT {
+	if len(id) != 20 {
+		id = make([]byte, 20)
+		rand.Read(id)
+	}
+
+	d := &DHT{
+		ID:        id,
+		conn:      conn,
+		bootstrap: bootstrap,
+		done:      make(chan struct{}),
+		table:     newRoutingTable(id),
+		pending:   make(map[string]*dhtPending),
+		peers:     make(map[string]map[string]time.Time),
+	}
+	d.rotateSecret()
+	d.rotateSecret()
+
+	return d
+}
+
+// Addr Direccion local en la que escucha el nodo
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// Start Empieza a atender queries y entra a la DHT a partir de los nodos guardados y los de bootstrap
+func (d *DHT) Start(nodes []DHTNodeInfo) {
+	go d.readLoop()
+	go d.refreshLoop()
+
+	go func() {
+		for _, n := range nodes {
+			addr, err := net.ResolveUDPAddr("udp", n.Addr)
+			if err == nil {
+				d.Ping(addr)
+			}
+		}
+		d.Bootstrap()
+	}()
+}
+
+// Close TODO
+func (d *DHT) Close() error {
+	select {
+	case <-d.done:
+		return nil
+	default:
+	}
+	close(d.done)
+	return d.conn.Close()
+}
+
+// Nodes Los nodos buenos de la tabla de ruteo, para guardarlos
+func (d *DHT) Nodes() []DHTNodeInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.table.nodes()
+}
+
+// Bootstrap Busca nuestro propio ID para llenar la tabla de ruteo
+func (d *DHT) Bootstrap() {
+	d.mutex.Lock()
+	empty := d.table.count() == 0
+	d.mutex.Unlock()
+
+	if empty {
+		for _, b := range d.bootstrap {
+			addr, err := net.ResolveUDPAddr("udp", b)
+			if err != nil {
+				log.Println("Could not resolve DHT bootstrap node " + b + ": " + err.Error())
+				continue
+			}
+			d.FindNode(addr, d.ID)
+		}
+	}
+
+	d.lookup(d.ID, "find_node")
+}
+
+// Ping TODO
+func (d *DHT) Ping(addr *net.UDPAddr) error {
+	_, err := d.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// FindNode Le pide a un nodo los nodos mas cercanos a target y los agrega a la tabla
+func (d *DHT) FindNode(addr *net.UDPAddr, target []byte) ([]*dhtNode, error) {
+	res, err := d.query(addr, "find_node", map[string]interface{}{"target": string(target)})
+	if err != nil {
+		return nil, err
+	}
+	return d.learnNodes(res), nil
+}
+
+// GetPeers Busca pares para el info hash en la DHT y los anuncia con OnPeers.
+// Si port no es 0 ademas nos anunciamos con announce_peer en los nodos mas cercanos.
+func (d *DHT) GetPeers(infoHash []byte, port int) []*net.TCPAddr {
+	peers, closest := d.lookup(infoHash, "get_peers")
+
+	if len(peers) > 0 && d.OnPeers != nil {
+		d.OnPeers(infoHash, peers)
+	}
+
+	if port > 0 {
+		for _, n := range closest {
+			if n.token == "" {
+				continue
+			}
+			go d.query(n.node.Addr, "announce_peer", map[string]interface{}{
+				"info_hash":    string(infoHash),
+				"port":         int64(port),
+				"implied_port": int64(0),
+				"token":        n.token,
+			})
+		}
+	}
+
+	return peers
+}
+
+// lookup Busqueda iterativa de Kademlia. Devuelve los pares encontrados (solo get_peers)
+// y los nodos mas cercanos que respondieron, con su token.
+func (d *DHT) lookup(target []byte, method string) ([]*net.TCPAddr, []*dhtLookupNode) {
+	d.mutex.Lock()
+	start := d.table.closest(target, dhtK)
+	d.mutex.Unlock()
+
+	var mutex sync.Mutex
+	var peers []*net.TCPAddr
+	var responded []*dhtLookupNode
+	seenPeers := make(map[string]bool)
+	candidates := make(map[string]*dhtLookupNode)
+	for _, n := range start {
+		candidates[string(n.ID)] = &dhtLookupNode{node: n}
+	}
+
+	for {
+		// Los k mas cercanos que todavia no consultamos
+		var all []*dhtNode
+		for _, c := range candidates {
+			all = append(all, c.node)
+		}
+		sortByDistance(all, target)
+		if len(all) > dhtK {
+			all = all[:dhtK]
+		}
+
+		var next []*dhtLookupNode
+		for _, n := range all {
+			c := candidates[string(n.ID)]
+			if !c.queried && len(next) < dhtAlpha {
+				next = append(next, c)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range next {
+			c.queried = true
+			wg.Add(1)
+			go func(c *dhtLookupNode) {
+				defer wg.Done()
+
+				args := map[string]interface{}{"target": string(target)}
+				if method == "get_peers" {
+					args = map[string]interface{}{"info_hash": string(target)}
+				}
+				res, err := d.query(c.node.Addr, method, args)
+				if err != nil {
+					return
+				}
+
+				nodes := d.learnNodes(res)
+
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				c.token, _ = res["token"].(string)
+				responded = append(responded, c)
+				for _, n := range nodes {
+					if _, ok := candidates[string(n.ID)]; !ok && !bytes.Equal(n.ID, d.ID) {
+						candidates[string(n.ID)] = &dhtLookupNode{node: n}
+					}
+				}
+
+				values, _ := res["values"].([]interface{})
+				for _, v := range values {
+					s, ok := v.(string)
+					if !ok || len(s) != 6 || seenPeers[s] {
+						continue
+					}
+					seenPeers[s] = true
+					peers = append(peers, &net.TCPAddr{
+						IP:   net.IPv4(s[0], s[1], s[2], s[3]),
+						Port: int(binary.BigEndian.Uint16([]byte(s[4:6]))),
+					})
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	var closest []*dhtNode
+	byID := make(map[string]*dhtLookupNode)
+	for _, c := range responded {
+		closest = append(closest, c.node)
+		byID[string(c.node.ID)] = c
+	}
+	sortByDistance(closest, target)
+	if len(closest) > dhtK {
+		closest = closest[:dhtK]
+	}
+	ret := make([]*dhtLookupNode, len(closest))
+	for i, n := range closest {
+		ret[i] = byID[string(n.ID)]
+	}
+
+	return peers, ret
+}
+
+// learnNodes Saca los nodos de una respuesta
+func (d *DHT) learnNodes(res map[string]interface{}) []*dhtNode {
+	s, _ := res["nodes"].(string)
+	return parseCompactNodes(s)
+}
+
+// query Manda una query y espera la respuesta
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(d.ID)
+
+	d.mutex.Lock()
+	d.tid++
+	tid := string([]byte{byte(d.tid >> 8), byte(d.tid)})
+	ch := make(chan map[string]interface{}, 1)
+	d.pending[tid] = &dhtPending{addr: addr, ch: ch}
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		delete(d.pending, tid)
+		d.mutex.Unlock()
+	}()
+
+	err := d.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		if res == nil {
+			return nil, errors.New("DHT node " + addr.String() + " returned an error to " + method)
+		}
+		return res, nil
+	case <-time.After(dhtQueryTimeout):
+		d.mutex.Lock()
+		d.table.failed(addr)
+		d.mutex.Unlock()
+		return nil, errors.New("DHT node " + addr.String() + " did not answer " + method)
+	case <-d.done:
+		return nil, errors.New("DHT closed")
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, msg); err != nil {
+		return err
+	}
+	_, err := d.conn.WriteTo(buf.Bytes(), addr)
+	return err
+}
+
+// readLoop GoRoutine que recibe todos los mensajes
+func (d *DHT) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Println("DHT closed: " + err.Error())
+			return
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		d.handlePacket(buf[:n], addr)
+	}
+}
+
+// handlePacket Procesa un mensaje KRPC
+func (d *DHT) handlePacket(data []byte, addr *net.UDPAddr) {
+	msg, err := decodeDict(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	tid := dictString(msg, "t")
+	switch dictString(msg, "y") {
+	case "q":
+		d.handleQuery(msg, tid, addr)
+
+	case "r":
+		res, ok := msg["r"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		d.mutex.Lock()
+		p := d.pendingFrom(tid, addr)
+		if p != nil {
+			d.table.seen([]byte(dictString(res, "id")), addr)
+		}
+		d.mutex.Unlock()
+		if p != nil {
+			p.deliver(res)
+		}
+
+	case "e":
+		d.mutex.Lock()
+		p := d.pendingFrom(tid, addr)
+		d.mutex.Unlock()
+		if p != nil {
+			p.deliver(nil)
+		}
+	}
+}
+
+// pendingFrom La query que espera esta respuesta. Solo cuenta si viene del nodo al que le preguntamos,
+// los transaction id son faciles de adivinar. Se llama con mutex tomado.
+func (d *DHT) pendingFrom(tid string, addr *net.UDPAddr) *dhtPending {
+	p, ok := d.pending[tid]
+	if !ok || !p.addr.IP.Equal(addr.IP) || p.addr.Port != addr.Port {
+		return nil
+	}
+	return p
+}
+
+// dhtPending Una query esperando respuesta
+type dhtPending struct {
+	addr *net.UDPAddr
+	ch   chan map[string]interface{}
+}
+
+// deliver Le pasa la respuesta a la query. Si ya tenia una (respuesta duplicada) la descartamos
+// en vez de trabar la lectura del socket.
+func (p *dhtPending) deliver(res map[string]interface{}) {
+	select {
+	case p.ch <- res:
+	default:
+	}
+}
+
+// handleQuery Responde una query de otro nodo
+func (d *DHT) handleQuery(msg map[string]interface{}, tid string, addr *net.UDPAddr) {
+	args, ok := msg["a"].(map[string]interface{})
+	if !ok {
+		d.sendError(addr, tid, 203, "Missing arguments")
+		return
+	}
+	id := dictString(args, "id")
+	if len(id) != 20 {
+		d.sendError(addr, tid, 203, "Invalid id")
+		return
+	}
+
+	d.mutex.Lock()
+	d.table.seen([]byte(id), addr)
+	d.mutex.Unlock()
+
+	res := map[string]interface{}{"id": string(d.ID)}
+
+	switch dictString(msg, "q") {
+	case "ping":
+
+	case "find_node":
+		target := dictString(args, "target")
+		if len(target) != 20 {
+			d.sendError(addr, tid, 203, "Invalid target")
+			return
+		}
+		d.mutex.Lock()
+		res["nodes"] = compactNodes(d.table.closest([]byte(target), dhtK))
+		d.mutex.Unlock()
+
+	case "get_peers":
+		infoHash := dictString(args, "info_hash")
+		if len(infoHash) != 20 {
+			d.sendError(addr, tid, 203, "Invalid info_hash")
+			return
+		}
+		d.mutex.Lock()
+		res["token"] = d.token(addr.IP)
+		if values := d.storedPeers(infoHash); len(values) > 0 {
+			res["values"] = values
+		} else {
+			res["nodes"] = compactNodes(d.table.closest([]byte(infoHash), dhtK))
+		}
+		d.mutex.Unlock()
+
+	case "announce_peer":
+		infoHash := dictString(args, "info_hash")
+		if len(infoHash) != 20 {
+			d.sendError(addr, tid, 203, "Invalid info_hash")
+			return
+		}
+		port := int(dictInt(args, "port"))
+		if dictInt(args, "implied_port") != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(addr, tid, 203, "Invalid port")
+			return
+		}
+
+		d.mutex.Lock()
+		valid := d.validToken(dictString(args, "token"), addr.IP)
+		if valid {
+			d.storePeer(infoHash, &net.TCPAddr{IP: addr.IP, Port: port})
+		}
+		d.mutex.Unlock()
+		if !valid {
+			d.sendError(addr, tid, 203, "Invalid token")
+			return
+		}
+
+	default:
+		d.sendError(addr, tid, 204, "Method Unknown")
+		return
+	}
+
+	d.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "r",
+		"r": res,
+	})
+}
+
+func (d *DHT) sendError(addr *net.UDPAddr, tid string, code int64, message string) {
+	d.send(addr, map[string]interface{}{
+		"t": tid,
+		"y": "e",
+		"e": []interface{}{code, message},
+	})
+}
+
+// rotateSecret Cambia el secreto de los tokens. El anterior sigue valiendo hasta la proxima rotacion.
+// Se llama con el mutex tomado.
+func (d *DHT) rotateSecret() {
+	d.prevSecret = d.secret
+	d.secret = make([]byte, 16)
+	rand.Read(d.secret)
+	d.secretTime = time.Now()
+}
+
+// token El token que le damos a ip en get_peers. Se llama con el mutex tomado.
+func (d *DHT) token(ip net.IP) string {
+	if time.Since(d.secretTime) > dhtSecretRotation {
+		d.rotateSecret()
+	}
+	return tokenFor(d.secret, ip)
+}
+
+// validToken Se llama con el mutex tomado
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	if time.Since(d.secretTime) > dhtSecretRotation {
+		d.rotateSecret()
+	}
+	return token == tokenFor(d.secret, ip) || token == tokenFor(d.prevSecret, ip)
+}
+
+func tokenFor(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip)
+	return string(h.Sum(nil)[:8])
+}
+
+// storePeer Se llama con el mutex tomado
+func (d *DHT) storePeer(infoHash string, addr *net.TCPAddr) {
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if len(peers) >= dhtMaxPeersPerHash {
+		return
+	}
+
+	ip := addr.IP.To4()
+	if ip == nil {
+		return
+	}
+	compact := make([]byte, 6)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[4:], uint16(addr.Port))
+	peers[string(compact)] = time.Now()
+}
+
+// storedPeers Los pares que se anunciaron para el info hash. Se llama con el mutex tomado.
+func (d *DHT) storedPeers(infoHash string) []interface{} {
+	var ret []interface{}
+	for compact, t := range d.peers[infoHash] {
+		if time.Since(t) > dhtPeerTTL {
+			delete(d.peers[infoHash], compact)
+			continue
+		}
+		ret = append(ret, compact)
+	}
+	return ret
+}
+
+// refreshLoop GoRoutine que refresca los buckets que no cambiaron en un rato
+func (d *DHT) refreshLoop() {
+	ticker := time.NewTicker(dhtRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.mutex.Lock()
+		stale := d.table.staleBuckets()
+		var targets [][]byte
+		for _, i := range stale {
+			targets = append(targets, d.table.randomIDInBucket(i))
+		}
+		empty := d.table.count() == 0
+		d.mutex.Unlock()
+
+		if empty {
+			d.Bootstrap()
+			continue
+		}
+		for _, target := range targets {
+			d.lookup(target, "find_node")
+		}
+	}
+}
+
+// String TODO
+func (d *DHT) String() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return fmt.Sprintf("DHT %X (%d nodes)", d.ID, d.table.count())
+}
+
+// dhtAnnounceInterval Cada cuanto buscamos pares en la DHT para cada torrent
+const dhtAnnounceInterval = 5 * time.Minute
+
+// StartDHT Levanta el nodo DHT en el puerto UDP de la sesion, que comparte con uTP, y empieza a buscar pares para los torrents
+func (s *Session) StartDHT() error {
+	if s.dht != nil {
+		return nil
+	}
+
+	bootstrap := s.DHTBootstrap
+	if len(bootstrap) == 0 {
+		bootstrap = defaultDHTBootstrap
+	}
+
+	m, err := s.udpSocket()
+	if err != nil {
+		return err
+	}
+	d := newDHT(m.packetConn(), s.DHTNodeID, bootstrap)
+	s.DHTNodeID = d.ID
+	d.OnPeers = s.dhtPeers
+	s.dht = d
+
+	d.Start(s.DHTNodes)
+	go s.dhtLoop(d)
+	return nil
+}
+
+// dhtLoop GoRoutine que busca y anuncia en la DHT los torrents activos (bajando o sembrando) que no son privados
+func (s *Session) dhtLoop(d *DHT) {
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, t := range s.AllTorrents {
+			if t.status() == Stopped || t.File.Info.Private {
+				continue
+			}
+			go d.GetPeers(t.File.InfoHash, int(s.port))
+		}
+
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dhtPeers Agrega al torrent los pares que encontro la DHT
+func (s *Session) dhtPeers(infoHash []byte, peers []*net.TCPAddr) {
+	t := s.findTorrent(infoHash)
+	if t == nil || t.File.Info.Private {
+		return
+	}
+
+	for _, addr := range peers {
+		p := &Peer{
+			IP:         addr.IP,
+			Port:       uint16(addr.Port),
+			Choked:     true,
+			Interested: false,
+		}
+		p.Init()
+		t.addPeer(p)
+	}
+}
+
+// dhtPing Un par nos anuncio su puerto DHT, lo sumamos a la tabla de ruteo
+func (s *Session) dhtPing(ip net.IP, port uint16) {
+	if s.dht == nil || port == 0 {
+		return
+	}
+	go s.dht.Ping(&net.UDPAddr{IP: ip, Port: int(port)})
+}
@@ -0,0 +1,250 @@
+package libgorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// dhtK Cantidad de nodos por bucket y de nodos que devuelve find_node
+	dhtK = 8
+
+	// dhtBuckets Un bucket por cada bit del ID
+	dhtBuckets = 160
+
+	// dhtQuestionableAfter Un nodo del que no sabemos nada hace este tiempo es dudoso
+	dhtQuestionableAfter = 15 * time.Minute
+
+	// dhtMaxFailures Despues de esta cantidad de queries sin respuesta el nodo se puede reemplazar
+	dhtMaxFailures = 2
+)
+
+// dhtNode Un nodo conocido de la DHT
+type dhtNode struct {
+	ID       []byte
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	Failures int
+}
+
+// good TODO
+func (n *dhtNode) good() bool {
+	return n.Failures < dhtMaxFailures && time.Since(n.LastSeen) < dhtQuestionableAfter
+}
+
+// DHTNodeInfo Un nodo de la tabla de ruteo tal como se guarda en la sesion
+type DHTNodeInfo struct {
+	ID   []byte
+	Addr string
+}
+
+// dhtBucket TODO
+type dhtBucket struct {
+	nodes       []*dhtNode
+	lastChanged time.Time
+}
+
+// routingTable Tabla de ruteo de Kademlia. El bucket i tiene los nodos cuyo ID comparte exactamente i bits con el nuestro.
+// No es segura para usar desde varias goroutines, la DHT la protege con su mutex.
+type routingTable struct {
+	id      []byte
+	buckets [dhtBuckets]dhtBucket
+}
+
+func newRoutingTable(id []byte) *routingTable {
+	rt := &routingTable{id: id}
+	for i := range rt.buckets {
+		rt.buckets[i].lastChanged = time.Now()
+	}
+	return rt
+}
+
+// commonPrefix Cantidad de bits iniciales que comparten a y b
+func commonPrefix(a, b []byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			n := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return n
+		}
+	}
+	return len(a) * 8
+}
+
+// xorDistance TODO
+func xorDistance(a, b []byte) []byte {
+	d := make([]byte, len(a))
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+func (rt *routingTable) bucketFor(id []byte) *dhtBucket {
+	i := commonPrefix(rt.id, id)
+	if i >= dhtBuckets {
+		return nil
+	}
+	return &rt.buckets[i]
+}
+
+// seen Un nodo nos respondio o nos mando una query. Lo agrega si hay lugar o si puede reemplazar a uno malo.
+func (rt *routingTable) seen(id []byte, addr *net.UDPAddr) {
+	if len(id) != 20 || addr.Port == 0 {
+		return
+	}
+	b := rt.bucketFor(id)
+	if b == nil {
+		// Es nuestro propio ID
+		return
+	}
+
+	for _, n := range b.nodes {
+		if bytes.Equal(n.ID, id) {
+			n.Addr = addr
+			n.LastSeen = time.Now()
+			n.Failures = 0
+			b.lastChanged = time.Now()
+			return
+		}
+	}
+
+	node := &dhtNode{ID: append([]byte(nil), id...), Addr: addr, LastSeen: time.Now()}
+	if len(b.nodes) < dhtK {
+		b.nodes = append(b.nodes, node)
+		b.lastChanged = time.Now()
+		return
+	}
+
+	// El bucket esta lleno, solo reemplazamos nodos que dejaron de responder
+	for i, n := range b.nodes {
+		if n.Failures >= dhtMaxFailures {
+			b.nodes[i] = node
+			b.lastChanged = time.Now()
+			return
+		}
+	}
+}
+
+// failed El nodo en addr no respondio una query
+func (rt *routingTable) failed(addr *net.UDPAddr) {
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			if n.Addr.IP.Equal(addr.IP) && n.Addr.Port == addr.Port {
+				n.Failures++
+				return
+			}
+		}
+	}
+}
+
+// closest Los n nodos buenos mas cercanos a target
+func (rt *routingTable) closest(target []byte, n int) []*dhtNode {
+	var all []*dhtNode
+	for i := range rt.buckets {
+		for _, node := range rt.buckets[i].nodes {
+			if node.Failures < dhtMaxFailures {
+				all = append(all, node)
+			}
+		}
+	}
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// staleBuckets Buckets que no cambiaron en dhtQuestionableAfter y hay que refrescar
+func (rt *routingTable) staleBuckets() []int {
+	var ret []int
+	for i := range rt.buckets {
+		if len(rt.buckets[i].nodes) > 0 && time.Since(rt.buckets[i].lastChanged) > dhtQuestionableAfter {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// randomIDInBucket Un ID al azar que cae en el bucket i
+func (rt *routingTable) randomIDInBucket(i int) []byte {
+	id := make([]byte, 20)
+	rand.Read(id)
+	for bit := 0; bit <= i && bit < dhtBuckets; bit++ {
+		mask := byte(0x80 >> uint(bit%8))
+		own := rt.id[bit/8] & mask
+		if bit == i {
+			// El bit i tiene que ser distinto al nuestro
+			own ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | own
+	}
+	return id
+}
+
+// nodes Todos los nodos buenos, para guardarlos en la sesion
+func (rt *routingTable) nodes() []DHTNodeInfo {
+	var ret []DHTNodeInfo
+	for i := range rt.buckets {
+		for _, n := range rt.buckets[i].nodes {
+			if n.Failures < dhtMaxFailures {
+				ret = append(ret, DHTNodeInfo{ID: n.ID, Addr: n.Addr.String()})
+			}
+		}
+	}
+	return ret
+}
+
+// count TODO
+func (rt *routingTable) count() int {
+	n := 0
+	for i := range rt.buckets {
+		n += len(rt.buckets[i].nodes)
+	}
+	return n
+}
+
+func sortByDistance(nodes []*dhtNode, target []byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(xorDistance(nodes[i].ID, target), xorDistance(nodes[j].ID, target)) < 0
+	})
+}
+
+// compactNodes Codifica los nodos en el formato compacto de 26 bytes (ID, IPv4 y puerto)
+func compactNodes(nodes []*dhtNode) string {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf.Write(n.ID)
+		buf.Write(ip)
+		binary.Write(&buf, binary.BigEndian, uint16(n.Addr.Port))
+	}
+	return buf.String()
+}
+
+// parseCompactNodes TODO
+func parseCompactNodes(data string) []*dhtNode {
+	var ret []*dhtNode
+	for i := 0; i+26 <= len(data); i += 26 {
+		entry := []byte(data[i : i+26])
+		port := binary.BigEndian.Uint16(entry[24:26])
+		if port == 0 {
+			continue
+		}
+		ret = append(ret, &dhtNode{
+			ID:   entry[0:20],
+			Addr: &net.UDPAddr{IP: net.IP(entry[20:24]), Port: int(port)},
+		})
+	}
+	return ret
+}
@@ -0,0 +1,180 @@
+package libgorrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// testDHT Un nodo DHT en loopback sin nodos de bootstrap
+func testDHT(t *testing.T) *DHT {
+	d, err := NewDHT("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Start(nil)
+	return d
+}
+
+func udpAddrOf(d *DHT) *net.UDPAddr {
+	return d.Addr().(*net.UDPAddr)
+}
+
+func shortDHTTimeout() func() {
+	old := dhtQueryTimeout
+	dhtQueryTimeout = 500 * time.Millisecond
+	return func() { dhtQueryTimeout = old }
+}
+
+func TestDHTPingFindNode(t *testing.T) {
+	defer shortDHTTimeout()()
+	a, b, c := testDHT(t), testDHT(t), testDHT(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	if err := a.Ping(udpAddrOf(b)); err != nil {
+		t.Fatal(err)
+	}
+	// Los dos quedan en la tabla del otro
+	if len(a.Nodes()) != 1 || len(b.Nodes()) != 1 || !bytes.Equal(b.Nodes()[0].ID, a.ID) {
+		t.Fatalf("a knows %v, b knows %v", a.Nodes(), b.Nodes())
+	}
+
+	// b conoce a c, a lo encuentra preguntandole a b
+	if err := c.Ping(udpAddrOf(b)); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := a.FindNode(udpAddrOf(b), c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range nodes {
+		if bytes.Equal(n.ID, c.ID) && n.Addr.Port == udpAddrOf(c).Port {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("find_node did not return c: %v", nodes)
+	}
+
+	// Un nodo que no existe no contesta
+	dead, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1")
+	if err := a.Ping(dead); err == nil {
+		t.Fatal("ping to a closed port answered")
+	}
+}
+
+func TestDHTAnnouncePeerToken(t *testing.T) {
+	defer shortDHTTimeout()()
+	a, b := testDHT(t), testDHT(t)
+	defer a.Close()
+	defer b.Close()
+
+	hash := string(bytes.Repeat([]byte{0xAB}, 20))
+	res, err := a.query(udpAddrOf(b), "get_peers", map[string]interface{}{"info_hash": hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := dictString(res, "token")
+	if token == "" || res["values"] != nil {
+		t.Fatalf("get_peers before announcing: %v", res)
+	}
+
+	// Con un token inventado no se anuncia
+	_, err = a.query(udpAddrOf(b), "announce_peer", map[string]interface{}{
+		"info_hash": hash, "port": int64(6881), "token": "nope",
+	})
+	if err == nil {
+		t.Fatal("announce_peer with a bad token was accepted")
+	}
+
+	_, err = a.query(udpAddrOf(b), "announce_peer", map[string]interface{}{
+		"info_hash": hash, "port": int64(6881), "token": token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ahora cualquiera que busque el hash nos encuentra
+	c := testDHT(t)
+	defer c.Close()
+	c.Ping(udpAddrOf(b))
+	peers := c.GetPeers([]byte(hash), 0)
+	if len(peers) != 1 || !peers[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || peers[0].Port != 6881 {
+		t.Fatalf("get_peers returned %v", peers)
+	}
+}
+
+func TestDHTGetPeersAnnounces(t *testing.T) {
+	defer shortDHTTimeout()()
+	a, b, c := testDHT(t), testDHT(t), testDHT(t)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	a.Ping(udpAddrOf(b))
+	c.Ping(udpAddrOf(b))
+
+	hash := bytes.Repeat([]byte{0x42}, 20)
+	a.GetPeers(hash, 7000)
+	// El announce_peer sale en otra GoRoutine
+	var peers []*net.TCPAddr
+	for i := 0; i < 20 && len(peers) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		peers = c.GetPeers(hash, 0)
+	}
+	if len(peers) != 1 || peers[0].Port != 7000 {
+		t.Fatalf("get_peers returned %v", peers)
+	}
+}
+
+func TestDHTReplyFromOtherNode(t *testing.T) {
+	d, err := NewDHT("127.0.0.1:0", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	queried := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4001}
+	ch := make(chan map[string]interface{}, 1)
+	d.pending["\x00\x01"] = &dhtPending{addr: queried, ch: ch}
+
+	reply := func(id string) []byte {
+		var buf bytes.Buffer
+		bencode.Marshal(&buf, map[string]interface{}{
+			"t": "\x00\x01",
+			"y": "r",
+			"r": map[string]interface{}{"id": id},
+		})
+		return buf.Bytes()
+	}
+
+	d.handlePacket(reply("spoofed-spoofed-spoo"), other)
+	select {
+	case res := <-ch:
+		t.Fatalf("took a reply from another node: %v", res)
+	default:
+	}
+
+	// Las respuestas duplicadas no pueden trabar la lectura
+	done := make(chan struct{})
+	go func() {
+		d.handlePacket(reply("first-first-first-fi"), queried)
+		d.handlePacket(reply("again-again-again-ag"), queried)
+		d.handlePacket([]byte("d1:eli201e5:oopse1:t2:\x00\x011:y1:ee"), queried)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("duplicate reply blocked handlePacket")
+	}
+	if res := <-ch; dictString(res, "id") != "first-first-first-fi" {
+		t.Fatalf("got %v", res)
+	}
+}
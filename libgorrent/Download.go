@@ -0,0 +1,491 @@
+package libgorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const (
+	// blockSize Tamaño de cada pedido. Casi todos los clientes rechazan pedidos mas grandes.
+	blockSize = 16 * 1024
+
+	// maxPipelineRequests Pedidos pendientes que mantenemos con cada par
+	maxPipelineRequests = 10
+)
+
+// blockRequest Un bloque dentro de una pieza
+type blockRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// pieceBuffer Una pieza que se esta armando a partir de bloques
+type pieceBuffer struct {
+	data []byte
+	// Cantidad de pares a los que se les pidio cada bloque. En endgame puede ser mas de uno.
+	requested []int
+	received  []bool
+	pending   int
+}
+
+func newPieceBuffer(length int64) *pieceBuffer {
+	nblocks := int((length + blockSize - 1) / blockSize)
+	return &pieceBuffer{
+		data:      make([]byte, length),
+		requested: make([]int, nblocks),
+		received:  make([]bool, nblocks),
+		pending:   nblocks,
+	}
+}
+
+// block Devuelve el pedido correspondiente al bloque i de la pieza
+func (pb *pieceBuffer) block(index int, i int) blockRequest {
+	begin := i * blockSize
+	length := len(pb.data) - begin
+	if length > blockSize {
+		length = blockSize
+	}
+	return blockRequest{
+		Index:  uint32(index),
+		Begin:  uint32(begin),
+		Length: uint32(length),
+	}
+}
+
+// reset Descarta todo lo recibido. Se usa cuando el hash no coincide.
+func (pb *pieceBuffer) reset() {
+	for i := range pb.requested {
+		pb.requested[i] = 0
+		pb.received[i] = false
+	}
+	pb.pending = len(pb.requested)
+}
+
+// hasUnrequested Quedan bloques que nadie pidio
+func (pb *pieceBuffer) hasUnrequested() bool {
+	for i := range pb.requested {
+		if pb.requested[i] == 0 && !pb.received[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// idle La pieza no tiene ningun bloque pedido ni recibido
+func (pb *pieceBuffer) idle() bool {
+	for i := range pb.requested {
+		if pb.requested[i] > 0 || pb.received[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// GetPieceLength Devuelve el tamaño de la pieza index. La ultima pieza suele ser mas chica.
+func (t *TorrentFile) GetPieceLength(index int) int64 {
+	plen := int64(t.Info.PieceLength)
+	if index == len(t.Info.Pieces)-1 {
+		if last := t.GetLength() - int64(index)*plen; last > 0 {
+			return last
+		}
+	}
+	return plen
+}
+
+// isInteresting Indica si el par tiene alguna pieza que nos falta
+func (t *Torrent) isInteresting(p *Peer) bool {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	for i := range t.Bitmap {
+		if t.Bitmap[i].Flag != FlagCompleted && p.Pieces.Has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextRequests Elige hasta n bloques para pedirle al par entre las piezas de has.
+// Las piezas las elige el PiecePicker, salvo que el par nos haya sugerido alguna.
+func (t *Torrent) nextRequests(p *Peer, has Bitfield, n int) []blockRequest {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	if t.downloading == nil {
+		t.downloading = make(map[int]*pieceBuffer)
+	}
+	if p.requests == nil {
+		p.requests = make(map[blockRequest]struct{})
+	}
+
+	var ret []blockRequest
+	for len(ret) < n {
+		index := t.pickSuggested(p, has)
+		if index < 0 {
+			index = t.picker.Pick(has)
+		}
+		if index < 0 {
+			break
+		}
+
+		pb, ok := t.downloading[index]
+		if !ok {
+			pb = newPieceBuffer(t.File.GetPieceLength(index))
+			t.downloading[index] = pb
+			t.Bitmap[index].Flag = FlagRequested
+		}
+
+		for i := range pb.requested {
+			if len(ret) >= n {
+				break
+			}
+			if pb.requested[i] > 0 || pb.received[i] {
+				continue
+			}
+			pb.requested[i]++
+			req := pb.block(index, i)
+			p.requests[req] = struct{}{}
+			ret = append(ret, req)
+		}
+
+		t.picker.SetPartial(index, pb.hasUnrequested())
+	}
+
+	t.updateEndgame()
+	if t.Endgame && len(ret) < n {
+		ret = append(ret, t.endgameRequests(p, has, n-len(ret))...)
+	}
+
+	return ret
+}
+
+// updateEndgame Entramos en endgame cuando no queda ningun bloque sin pedir.
+// Si un par se va y libera sus pedidos volvemos al modo normal.
+// Se llama con mutexPieces tomado.
+func (t *Torrent) updateEndgame() {
+	endgame := len(t.downloading) > 0
+	for i := range t.Bitmap {
+		if !endgame {
+			break
+		}
+		if t.Bitmap[i].Flag == FlagNone {
+			endgame = false
+		}
+	}
+	for _, pb := range t.downloading {
+		if !endgame {
+			break
+		}
+		if pb.hasUnrequested() {
+			endgame = false
+		}
+	}
+
+	if endgame != t.Endgame {
+		log.Printf("%s: endgame %v\n", t.File.Info.Name, endgame)
+	}
+	t.Endgame = endgame
+}
+
+// endgameRequests En endgame le pedimos al par los bloques que faltan aunque ya se los hayamos pedido a otro.
+// Se llama con mutexPieces tomado.
+func (t *Torrent) endgameRequests(p *Peer, has Bitfield, n int) []blockRequest {
+	var ret []blockRequest
+	for index, pb := range t.downloading {
+		if !has.Has(index) {
+			continue
+		}
+		for i := range pb.received {
+			if len(ret) >= n {
+				return ret
+			}
+			if pb.received[i] {
+				continue
+			}
+			req := pb.block(index, i)
+			if _, ok := p.requests[req]; ok {
+				continue
+			}
+			pb.requested[i]++
+			p.requests[req] = struct{}{}
+			ret = append(ret, req)
+		}
+	}
+	return ret
+}
+
+// releaseRequests Libera los pedidos pendientes del par para que los tome otro
+func (t *Torrent) releaseRequests(p *Peer) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	for req := range p.requests {
+		t.releaseRequest(req)
+	}
+	p.requests = nil
+}
+
+// rejectRequest El par rechazo un pedido (Fast Extension), lo liberamos para que lo tome otro
+func (t *Torrent) rejectRequest(p *Peer, req blockRequest) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	if _, ok := p.requests[req]; !ok {
+		return
+	}
+	delete(p.requests, req)
+	t.releaseRequest(req)
+}
+
+// releaseRequest Un pedido ya no esta pendiente. Se llama con mutexPieces tomado.
+func (t *Torrent) releaseRequest(req blockRequest) {
+	pb, ok := t.downloading[int(req.Index)]
+	if !ok {
+		return
+	}
+
+	i := int(req.Begin / blockSize)
+	if !pb.received[i] && pb.requested[i] > 0 {
+		pb.requested[i]--
+	}
+
+	if pb.idle() {
+		delete(t.downloading, int(req.Index))
+		t.Bitmap[req.Index].Flag = FlagNone
+		t.picker.SetPartial(int(req.Index), false)
+	} else {
+		t.picker.SetPartial(int(req.Index), pb.hasUnrequested())
+	}
+}
+
+// peerBitfield El par mando su bitfield, reemplaza al que tenia.
+// Si ya sabemos cuantas piezas hay tiene que tener el tamaño justo.
+func (t *Torrent) peerBitfield(p *Peer, b Bitfield) error {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	if t.File.HasInfo() && !b.valid(len(t.Bitmap)) {
+		return fmt.Errorf("Invalid bitfield of %d bytes for %d pieces", len(b), len(t.Bitmap))
+	}
+	t.picker.RemoveBitfield(p.Pieces)
+	p.Pieces = append(Bitfield(nil), b...)
+	t.picker.AddBitfield(p.Pieces)
+	return nil
+}
+
+// peerHave El par anuncio una pieza
+func (t *Torrent) peerHave(p *Peer, index int) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	if p.Pieces.Has(index) {
+		return
+	}
+	if index >= len(t.Bitmap) {
+		// Sin metadata no sabemos cuantas piezas hay, lo guardamos igual para cuando llegue
+		if t.File.HasInfo() || index >= maxMetadataSize/sha1.Size {
+			return
+		}
+	}
+	p.Pieces.Set(index)
+	t.picker.AddHave(index)
+}
+
+// peerGone El par se desconecto, sus piezas ya no estan disponibles.
+// Si se vuelve a conectar manda su bitfield de nuevo, no nos quedamos con el viejo.
+func (t *Torrent) peerGone(p *Peer) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	t.picker.RemoveBitfield(p.Pieces)
+	p.Pieces = nil
+	p.haveAll = false
+}
+
+// errHashFailed La pieza que se completo con el bloque no paso la verificacion del hash.
+// Los bloques se descartan y se vuelve a pedir.
+var errHashFailed = errors.New("Piece failed hash check")
+
+// blockReceived Guarda un bloque recibido del par. Cuando la pieza esta completa verifica el hash.
+func (t *Torrent) blockReceived(p *Peer, index, begin uint32, data []byte) error {
+	req := blockRequest{Index: index, Begin: begin, Length: uint32(len(data))}
+
+	t.mutexPieces.Lock()
+	if _, ok := p.requests[req]; !ok {
+		t.mutexPieces.Unlock()
+		// No lo pedimos (o ya lo cancelamos), lo ignoramos
+		return nil
+	}
+	delete(p.requests, req)
+
+	pb, ok := t.downloading[int(index)]
+	if !ok {
+		t.mutexPieces.Unlock()
+		return nil
+	}
+
+	i := int(begin / blockSize)
+	if begin%blockSize != 0 || i >= len(pb.received) || pb.block(int(index), i) != req {
+		t.mutexPieces.Unlock()
+		return fmt.Errorf("Invalid block %d:%d+%d", index, begin, len(data))
+	}
+
+	if pb.received[i] {
+		t.mutexPieces.Unlock()
+		return nil
+	}
+
+	copy(pb.data[begin:], data)
+	pb.received[i] = true
+	pb.pending--
+
+	if pb.requested[i] > 1 {
+		// Endgame, a los demas pares que se lo pedimos les avisamos que ya no hace falta
+		cancel := t.takeDuplicateRequests(p, req)
+		defer func() {
+			for _, other := range cancel {
+				other.Send(&Message{ID: MsgCancel, Index: req.Index, Begin: req.Begin, Length: req.Length})
+			}
+		}()
+	}
+
+	if pb.pending > 0 {
+		t.mutexPieces.Unlock()
+		return nil
+	}
+
+	hash := sha1.Sum(pb.data)
+	if !bytes.Equal(hash[:], t.File.Info.Pieces[index]) {
+		log.Printf("Piece %d failed hash check\n", index)
+		pb.reset()
+		t.picker.SetPartial(int(index), true)
+		t.mutexPieces.Unlock()
+		return errHashFailed
+	}
+
+	delete(t.downloading, int(index))
+	t.mutexPieces.Unlock()
+
+	if err := t.writeBlock(int(index), 0, pb.data); err != nil {
+		t.mutexPieces.Lock()
+		t.Bitmap[index].Flag = FlagNone
+		t.mutexPieces.Unlock()
+		return errors.New("Could not write piece " + strconv.Itoa(int(index)) + ": " + err.Error())
+	}
+
+	t.mutexPieces.Lock()
+	t.Bitmap[index].Flag = FlagCompleted
+	t.Downloaded += int64(len(pb.data))
+	t.Left -= int64(len(pb.data))
+	finished := false
+	if t.Left <= 0 {
+		t.Left = 0
+		// Un torrent parado sigue parado aunque le llegue la ultima pieza
+		if t.Status == Started {
+			finished = true
+			t.Status = Completed
+		}
+	}
+	t.mutexPieces.Unlock()
+
+	t.pieceCompleted(int(index))
+	if finished {
+		t.downloadCompleted()
+	}
+	return nil
+}
+
+// takeDuplicateRequests Saca req de los pedidos pendientes de todos los pares menos p.
+// Devuelve los pares a los que hay que mandarles Cancel. Se llama con mutexPieces tomado.
+// Las web seeds tambien lo sueltan, pero a ellas no hay que avisarles nada.
+func (t *Torrent) takeDuplicateRequests(p *Peer, req blockRequest) []*Peer {
+	for _, ws := range t.webSeeds {
+		if ws.peer != p {
+			delete(ws.peer.requests, req)
+		}
+	}
+
+	t.mutexPeers.RLock()
+	defer t.mutexPeers.RUnlock()
+
+	var ret []*Peer
+	for _, other := range t.Peers {
+		if other == p {
+			continue
+		}
+		if _, ok := other.requests[req]; ok {
+			delete(other.requests, req)
+			ret = append(ret, other)
+		}
+	}
+	return ret
+}
+
+// pieceCompleted Se llama una vez que la pieza fue verificada y guardada
+func (t *Torrent) pieceCompleted(index int) {
+	log.Printf("Piece %d completed\n", index)
+	t.broadcastHave(index)
+}
+
+// updateInterest Le avisa al par si estamos interesados o no en sus piezas
+func (p *Peer) updateInterest() error {
+	interested := p.torrent.isInteresting(p)
+	if interested == p.Interested {
+		return nil
+	}
+
+	p.Interested = interested
+	if interested {
+		return p.Send(&Message{ID: MsgInterested})
+	}
+	return p.Send(&Message{ID: MsgNotInterested})
+}
+
+// pipelineSize Pedidos pendientes que mantenemos con el par, sin pasarnos de lo que anuncio en reqq
+func (p *Peer) pipelineSize() int {
+	if p.MaxRequests > 0 && p.MaxRequests < maxPipelineRequests {
+		return p.MaxRequests
+	}
+	return maxPipelineRequests
+}
+
+// fillPipeline Mantiene pipelineSize pedidos pendientes con el par
+func (p *Peer) fillPipeline() error {
+	if !p.Interested {
+		return nil
+	}
+	has := p.Pieces
+	if p.Choked {
+		// Con la Fast Extension podemos pedir las piezas allowed fast aunque el par nos tenga choked
+		if !p.supportsFast() || p.AllowedFast.Count() == 0 {
+			return nil
+		}
+		has = p.Pieces.Intersect(p.AllowedFast)
+	}
+
+	p.torrent.mutexPieces.Lock()
+	n := p.pipelineSize() - len(p.requests)
+	p.torrent.mutexPieces.Unlock()
+	if n <= 0 {
+		return nil
+	}
+
+	for _, req := range p.torrent.nextRequests(p, has, n) {
+		err := p.Send(&Message{
+			ID:     MsgRequest,
+			Index:  req.Index,
+			Begin:  req.Begin,
+			Length: req.Length,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
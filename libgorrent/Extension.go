@@ -0,0 +1,198 @@
+package libgorrent
+
+import (
+	"bytes"
+	"errors"
+	"net"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+const (
+	// reservedExtension Bit de los reservados del handshake que indica soporte del protocolo de extensiones (BEP 10)
+	reservedExtension = 0x10
+
+	// extHandshake El mensaje extendido 0 es siempre el handshake
+	extHandshake = 0
+
+	// clientVersion Lo que mandamos en v del handshake extendido
+	clientVersion = "gorrent 0.0"
+)
+
+// Extension Una extension del protocolo de extensiones (BEP 10), como ut_metadata o ut_pex.
+// Se registran en la Session y cada par las negocia en el handshake extendido.
+type Extension struct {
+	// Name Nombre de la extension en el diccionario m
+	Name string
+	// Enabled Decide si ofrecemos la extension a este par. nil es siempre.
+	Enabled func(p *Peer) bool
+	// Extend Agrega claves propias a nuestro handshake extendido. Puede ser nil.
+	Extend func(p *Peer, dict map[string]interface{})
+	// Handshake Se llama cuando llega el handshake extendido de un par que anuncio la extension. Puede ser nil.
+	Handshake func(p *Peer, dict map[string]interface{}) error
+	// Handle Procesa un mensaje de la extension
+	Handle func(p *Peer, payload []byte) error
+
+	// Privates
+	id int
+}
+
+// RegisterExtension Agrega una extension. El id local es el orden de registro empezando en 1.
+func (s *Session) RegisterExtension(e *Extension) error {
+	if e.Name == "" || e.Handle == nil {
+		return errors.New("Extension needs a name and a handler")
+	}
+	if s.extension(e.Name) != nil {
+		return errors.New("Extension " + e.Name + " already registered")
+	}
+	if len(s.extensions) >= 255 {
+		return errors.New("Too many extensions")
+	}
+
+	e.id = len(s.extensions) + 1
+	s.extensions = append(s.extensions, e)
+	return nil
+}
+
+// extension Busca la extension por nombre
+func (s *Session) extension(name string) *Extension {
+	for _, e := range s.extensions {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// extensionEnabled La extension esta registrada y se la ofrecemos al par
+func (p *Peer) extensionEnabled(e *Extension) bool {
+	return e.Enabled == nil || e.Enabled(p)
+}
+
+// supportsExtensions El par anuncio soporte del protocolo de extensiones en el handshake
+func (p *Peer) supportsExtensions() bool {
+	return p.Reserved[5]&reservedExtension != 0
+}
+
+// SupportsExtension El par anuncio la extension en su handshake extendido
+func (p *Peer) SupportsExtension(name string) bool {
+	_, ok := p.Extensions[name]
+	return ok
+}
+
+// SendExtended Manda un mensaje de la extension name con un diccionario bencodeado y opcionalmente datos despues.
+// Usa el id que nos asigno el par, si no la anuncio devuelve error.
+func (p *Peer) SendExtended(name string, dict map[string]interface{}, data []byte) error {
+	id, ok := p.Extensions[name]
+	if !ok {
+		return errors.New("Peer " + p.String() + " does not support " + name)
+	}
+	return p.sendExtended(id, dict, data)
+}
+
+func (p *Peer) sendExtended(id int, dict map[string]interface{}, data []byte) error {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, dict); err != nil {
+		return err
+	}
+	buf.Write(data)
+
+	return p.Send(&Message{ID: MsgExtended, Extended: byte(id), Payload: buf.Bytes()})
+}
+
+// sendExtHandshake Le dice al par que extensiones soportamos y algunos datos nuestros
+func (p *Peer) sendExtHandshake() error {
+	s := p.torrent.session
+
+	m := make(map[string]interface{})
+	dict := map[string]interface{}{
+		"m":    m,
+		"v":    clientVersion,
+		"p":    int64(s.port),
+		"reqq": int64(maxUploadQueue),
+	}
+	if ip := p.IP.To4(); ip != nil {
+		dict["yourip"] = string(ip)
+	} else if len(p.IP) == net.IPv6len {
+		dict["yourip"] = string(p.IP)
+	}
+
+	for _, e := range s.extensions {
+		if !p.extensionEnabled(e) {
+			continue
+		}
+		m[e.Name] = int64(e.id)
+		if e.Extend != nil {
+			e.Extend(p, dict)
+		}
+	}
+
+	return p.sendExtended(extHandshake, dict, nil)
+}
+
+// handleExtended Procesa un mensaje extendido
+func (p *Peer) handleExtended(m *Message) error {
+	if m.Extended == extHandshake {
+		return p.handleExtHandshake(m.Payload)
+	}
+
+	for _, e := range p.torrent.session.extensions {
+		if e.id == int(m.Extended) && p.extensionEnabled(e) {
+			return e.Handle(p, m.Payload)
+		}
+	}
+
+	// Una extension que no anunciamos, la ignoramos
+	return nil
+}
+
+// handleExtHandshake Guarda lo que anuncio el par y le avisa a cada extension que el par soporta.
+// El par puede mandar mas de un handshake, cada uno actualiza lo anterior.
+func (p *Peer) handleExtHandshake(payload []byte) error {
+	dict, err := decodeDict(bytes.NewReader(payload))
+	if err != nil {
+		return errors.New("Invalid extension handshake: " + err.Error())
+	}
+
+	extensions := make(map[string]int)
+	for name, id := range p.Extensions {
+		extensions[name] = id
+	}
+	m, _ := dict["m"].(map[string]interface{})
+	for name, id := range m {
+		n, ok := id.(int64)
+		if !ok || n < 0 || n > 255 {
+			continue
+		}
+		if n == 0 {
+			// Id 0 es que la desactiva
+			delete(extensions, name)
+		} else {
+			extensions[name] = int(n)
+		}
+	}
+	p.Extensions = extensions
+
+	if v := dictString(dict, "v"); v != "" {
+		p.Client = v
+	}
+	if port := dictInt(dict, "p"); port > 0 && port <= 65535 {
+		p.ListenPort = uint16(port)
+	}
+	if reqq := dictInt(dict, "reqq"); reqq > 0 {
+		p.MaxRequests = int(reqq)
+	}
+	if ip := dictString(dict, "yourip"); len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+		p.YourIP = net.IP(ip)
+	}
+
+	for _, e := range p.torrent.session.extensions {
+		if e.Handshake == nil || !p.SupportsExtension(e.Name) || !p.extensionEnabled(e) {
+			continue
+		}
+		if err := e.Handshake(p, dict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
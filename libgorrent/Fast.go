@@ -0,0 +1,164 @@
+package libgorrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	// reservedFast Bit de los reservados del handshake que indica soporte de la Fast Extension (BEP 6)
+	reservedFast = 0x04
+
+	// allowedFastCount Cantidad de piezas allowed fast que le damos a cada par
+	allowedFastCount = 10
+
+	// maxSuggested Sugerencias que recordamos de cada par
+	maxSuggested = 32
+)
+
+// supportsFast El par anuncio soporte de la Fast Extension en el handshake
+func (p *Peer) supportsFast() bool {
+	return p.Reserved[7]&reservedFast != 0
+}
+
+// allowedFastSet Calcula el allowed fast set de k piezas para una IP (BEP 6).
+// Es determinista para que el par no gane nada reconectandose.
+func allowedFastSet(ip net.IP, infoHash []byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		// El algoritmo solo esta definido para IPv4
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash...)
+
+	var ret []int
+	seen := make(map[int]bool)
+	for len(ret) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(ret) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				ret = append(ret, index)
+			}
+		}
+	}
+	return ret
+}
+
+// sendAllowedFast Le manda al par las piezas que le vamos a atender aunque este choked
+func (p *Peer) sendAllowedFast() error {
+	set := allowedFastSet(p.IP, p.torrent.File.InfoHash, len(p.torrent.File.Info.Pieces), allowedFastCount)
+
+	var b Bitfield
+	for _, index := range set {
+		b.Set(index)
+	}
+	p.umu.Lock()
+	p.fastSet = b
+	p.umu.Unlock()
+
+	for _, index := range set {
+		if err := p.Send(&Message{ID: MsgAllowedFast, Index: uint32(index)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject Le avisa al par que no vamos a atender el pedido. Sin la Fast Extension no hay forma de decirlo.
+func (p *Peer) reject(req blockRequest) error {
+	if !p.supportsFast() {
+		return nil
+	}
+	return p.Send(&Message{ID: MsgReject, Index: req.Index, Begin: req.Begin, Length: req.Length})
+}
+
+// handleFast Procesa los mensajes de la Fast Extension
+func (p *Peer) handleFast(m *Message) error {
+	if !p.supportsFast() {
+		return errors.New("Peer sent " + m.ID.String() + " without supporting the Fast Extension")
+	}
+
+	t := p.torrent
+	switch m.ID {
+	case MsgHaveAll:
+		t.peerHaveAll(p)
+		if err := p.updateInterest(); err != nil {
+			return err
+		}
+		return p.fillPipeline()
+	case MsgHaveNone:
+		t.peerHaveNone(p)
+		return p.updateInterest()
+	case MsgReject:
+		// No lo volvemos a pedir enseguida, lo va a tomar el proximo fillPipeline
+		t.rejectRequest(p, blockRequest{Index: m.Index, Begin: m.Begin, Length: m.Length})
+	case MsgAllowedFast:
+		if t.File.HasInfo() && int(m.Index) >= len(t.File.Info.Pieces) {
+			return nil
+		}
+		p.AllowedFast.Set(int(m.Index))
+		return p.fillPipeline()
+	case MsgSuggest:
+		if int(m.Index) >= len(t.File.Info.Pieces) {
+			return nil
+		}
+		for _, x := range p.Suggested {
+			if x == int(m.Index) {
+				return nil
+			}
+		}
+		if len(p.Suggested) >= maxSuggested {
+			p.Suggested = p.Suggested[1:]
+		}
+		p.Suggested = append(p.Suggested, int(m.Index))
+	}
+	return nil
+}
+
+// peerHaveAll El par tiene todas las piezas. Si todavia no sabemos cuantas son lo anotamos para cuando llegue la metadata.
+func (t *Torrent) peerHaveAll(p *Peer) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	t.picker.RemoveBitfield(p.Pieces)
+	if !t.File.HasInfo() {
+		p.haveAll = true
+		p.Pieces = nil
+		return
+	}
+	p.Pieces = fullBitfield(len(t.Bitmap))
+	t.picker.AddBitfield(p.Pieces)
+}
+
+// peerHaveNone El par no tiene ninguna pieza
+func (t *Torrent) peerHaveNone(p *Peer) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	t.picker.RemoveBitfield(p.Pieces)
+	p.haveAll = false
+	p.Pieces = nil
+}
+
+// pickSuggested La primera pieza sugerida por el par que tiene y nadie empezo. Se llama con mutexPieces tomado.
+func (t *Torrent) pickSuggested(p *Peer, has Bitfield) int {
+	for len(p.Suggested) > 0 {
+		index := p.Suggested[0]
+		if has.Has(index) && index < len(t.Bitmap) && t.Bitmap[index].Flag == FlagNone {
+			return index
+		}
+		p.Suggested = p.Suggested[1:]
+	}
+	return -1
+}
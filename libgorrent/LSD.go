@@ -0,0 +1,245 @@
+package libgorrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lsdGroup4 Grupo multicast IPv4 de Local Service Discovery (BEP 14)
+	lsdGroup4 = "239.192.152.143:6771"
+
+	// lsdGroup6 Grupo multicast IPv6 de Local Service Discovery
+	lsdGroup6 = "[ff15::efc0:988f]:6771"
+
+	// lsdInterval Cada cuanto anunciamos los torrents activos
+	lsdInterval = 5 * time.Minute
+
+	// lsdMinInterval No anunciamos el mismo torrent mas de una vez por minuto
+	lsdMinInterval = time.Minute
+
+	// lsdMaxPacket Los anuncios son chicos, algo mas grande no es LSD
+	lsdMaxPacket = 1400
+)
+
+// lsd Estado de Local Service Discovery de la sesion
+type lsd struct {
+	cookie string
+	conns  []*net.UDPConn
+	groups []*net.UDPAddr
+	done   chan struct{}
+
+	mutex sync.Mutex
+	last  map[string]time.Time
+}
+
+// lsdAnnouncement Un BT-SEARCH ya parseado
+type lsdAnnouncement struct {
+	Port       int
+	InfoHashes [][]byte
+	Cookie     string
+}
+
+// StartLSD Empieza a anunciar los torrents activos en la red local y a escuchar los anuncios de otros
+func (s *Session) StartLSD() error {
+	if s.lsd != nil {
+		return nil
+	}
+
+	l := &lsd{
+		cookie: hex.EncodeToString(generateRandomBytes(8)),
+		done:   make(chan struct{}),
+		last:   make(map[string]time.Time),
+	}
+
+	for _, group := range []string{lsdGroup4, lsdGroup6} {
+		network := "udp4"
+		if strings.HasPrefix(group, "[") {
+			network = "udp6"
+		}
+		addr, err := net.ResolveUDPAddr(network, group)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, addr)
+		if err != nil {
+			// Es normal no tener IPv6, alcanza con uno de los dos
+			log.Println("Could not join LSD group " + group + ": " + err.Error())
+			continue
+		}
+		l.conns = append(l.conns, conn)
+		l.groups = append(l.groups, addr)
+	}
+	if len(l.conns) == 0 {
+		return errors.New("Could not start Local Service Discovery")
+	}
+
+	s.lsd = l
+	for _, conn := range l.conns {
+		go s.lsdReadLoop(conn)
+	}
+	go s.lsdLoop()
+	return nil
+}
+
+// lsdLoop GoRoutine que anuncia periodicamente los torrents activos
+func (s *Session) lsdLoop() {
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, t := range s.AllTorrents {
+			s.lsdAnnounce(t)
+		}
+
+		select {
+		case <-s.lsd.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lsdAnnounce Anuncia el torrent en la red local si esta activo (bajando o sembrando), no es privado y no lo anunciamos hace poco
+func (s *Session) lsdAnnounce(t *Torrent) {
+	l := s.lsd
+	if l == nil || t.status() == Stopped || t.File.Info.Private {
+		return
+	}
+
+	l.mutex.Lock()
+	key := string(t.File.InfoHash)
+	if time.Since(l.last[key]) < lsdMinInterval {
+		l.mutex.Unlock()
+		return
+	}
+	l.last[key] = time.Now()
+	l.mutex.Unlock()
+
+	for i, conn := range l.conns {
+		msg := encodeLSD(l.groups[i].String(), int(s.port), l.cookie, t.File.InfoHash)
+		if _, err := conn.WriteToUDP(msg, l.groups[i]); err != nil {
+			log.Println("LSD announce failed: " + err.Error())
+		}
+	}
+}
+
+// lsdReadLoop GoRoutine que recibe los anuncios de la red local
+func (s *Session) lsdReadLoop(conn *net.UDPConn) {
+	buf := make([]byte, lsdMaxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.lsd.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Println("LSD closed: " + err.Error())
+			return
+		}
+
+		a, err := parseLSD(buf[:n])
+		if err != nil || a.Cookie == s.lsd.cookie {
+			// No es un anuncio o es nuestro
+			continue
+		}
+		s.lsdPeer(from.IP, a)
+	}
+}
+
+// lsdPeer Agrega el par que se anuncio a los torrents que tenemos
+func (s *Session) lsdPeer(ip net.IP, a *lsdAnnouncement) {
+	for _, hash := range a.InfoHashes {
+		t := s.findTorrent(hash)
+		if t == nil || t.File.Info.Private {
+			continue
+		}
+
+		p := &Peer{
+			IP:         ip,
+			Port:       uint16(a.Port),
+			Choked:     true,
+			Interested: false,
+		}
+		p.Init()
+		t.addPeer(p)
+	}
+}
+
+// encodeLSD Arma un BT-SEARCH para uno o varios info hashes
+func encodeLSD(host string, port int, cookie string, hashes ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	fmt.Fprintf(&buf, "Port: %d\r\n", port)
+	for _, h := range hashes {
+		fmt.Fprintf(&buf, "Infohash: %s\r\n", hex.EncodeToString(h))
+	}
+	fmt.Fprintf(&buf, "cookie: %s\r\n", cookie)
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// parseLSD Parsea un BT-SEARCH. Los nombres de los headers no distinguen mayusculas.
+func parseLSD(data []byte) (*lsdAnnouncement, error) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	if !sc.Scan() || !strings.HasPrefix(sc.Text(), "BT-SEARCH * HTTP/1.1") {
+		return nil, errors.New("Not an LSD announcement")
+	}
+
+	a := &lsdAnnouncement{}
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[i+1:])
+
+		switch strings.ToLower(line[:i]) {
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, errors.New("Invalid LSD port " + value)
+			}
+			a.Port = port
+		case "infohash":
+			hash, err := hex.DecodeString(value)
+			if err != nil || len(hash) != 20 {
+				continue
+			}
+			a.InfoHashes = append(a.InfoHashes, hash)
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+
+	if a.Port == 0 || len(a.InfoHashes) == 0 {
+		return nil, errors.New("Incomplete LSD announcement")
+	}
+	return a, nil
+}
+
+// close TODO
+func (l *lsd) close() {
+	close(l.done)
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
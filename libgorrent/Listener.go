@@ -0,0 +1,162 @@
+package libgorrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// handshakeTimeout Tiempo que le damos a un par entrante para mandar el handshake
+const handshakeTimeout = 10 * time.Second
+
+// Listen Empieza a aceptar conexiones de pares en el puerto de la sesion, por TCP y por uTP
+func (s *Session) Listen() error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return errors.New("Could not listen on port " + fmt.Sprint(s.port) + ": " + err.Error())
+	}
+	s.listener = l
+	go s.acceptLoop(l)
+
+	if !s.DisableUTP {
+		m, err := s.udpSocket()
+		if err != nil {
+			return err
+		}
+		s.utpListener = m.listen()
+		go s.acceptLoop(s.utpListener)
+	}
+	return nil
+}
+
+// acceptLoop GoRoutine que acepta las conexiones entrantes
+func (s *Session) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Println("Listener closed: " + err.Error())
+			return
+		}
+
+		go s.handleIncoming(conn)
+	}
+}
+
+// handleIncoming Lee el handshake de un par entrante, busca el torrent y le pasa la conexion
+func (s *Session) handleIncoming(conn net.Conn) {
+	defer conn.Close()
+
+	var ip net.IP
+	var port int
+	utp := false
+	switch a := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+		utp = true
+	default:
+		return
+	}
+	addr := conn.RemoteAddr()
+
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	head, err := r.Peek(20)
+	if err != nil {
+		log.Printf("%21s Incoming handshake failed: %s\n", addr, err.Error())
+		return
+	}
+
+	encrypted := false
+	if isPlainHandshake(head) {
+		if s.Encryption == EncryptionRequire {
+			log.Printf("%21s Rejecting plaintext connection\n", addr)
+			return
+		}
+	} else {
+		if s.Encryption == EncryptionDisabled {
+			log.Printf("%21s Rejecting encrypted connection\n", addr)
+			return
+		}
+		ec, _, err := mseAccept(conn, r, s.infoHashes(), s.Encryption)
+		if err != nil {
+			log.Printf("%21s Incoming handshake failed: %s\n", addr, err.Error())
+			return
+		}
+		conn = ec
+		r = bufio.NewReader(conn)
+		encrypted = ec.enc != nil
+	}
+	w := bufio.NewWriter(conn)
+
+	c, err := readHandshake(r)
+	if err != nil {
+		log.Printf("%21s Incoming handshake failed: %s\n", addr, err.Error())
+		return
+	}
+
+	t := s.findTorrent(c.InfoHash[:])
+	if t == nil {
+		log.Printf("%21s Incoming connection for unknown torrent %X\n", addr, c.InfoHash)
+		return
+	}
+	if t.status() == Stopped {
+		log.Printf("%21s Incoming connection for stopped torrent %X\n", addr, c.InfoHash)
+		return
+	}
+
+	if err = writeHandshake(w, t.newHandshake()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	p := &Peer{
+		IP:         ip,
+		Port:       uint16(port),
+		Choked:     true,
+		Interested: false,
+	}
+	p.Init()
+	copy(p.PeerID[:], c.PeerID[:])
+	p.Reserved = c.Reserved
+	p.incoming = true
+	p.Encrypted = encrypted
+	p.UTP = utp
+
+	if !t.addIncomingPeer(p) {
+		return
+	}
+	defer func() {
+		p.using = false
+	}()
+	p.run(conn, r, w)
+}
+
+// infoHashes Los info hashes de todos los torrents, son las SKEY posibles de una conexion MSE entrante
+func (s *Session) infoHashes() [][]byte {
+	var ret [][]byte
+	for _, t := range s.AllTorrents {
+		ret = append(ret, t.File.InfoHash)
+	}
+	return ret
+}
+
+// findTorrent Busca el torrent de la sesion con ese info hash
+func (s *Session) findTorrent(infoHash []byte) *Torrent {
+	for _, t := range s.AllTorrents {
+		if bytes.Equal(t.File.InfoHash, infoHash) {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package libgorrent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddIncomingPeer(t *testing.T) {
+	tf, _ := testTorrentFile(t, 100000, 32768)
+	tor, err := testSession(22500).AddTorrent(tf, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	incoming := func(port uint16, id byte) *Peer {
+		p := &Peer{IP: net.IPv4(10, 0, 0, 1), Port: port}
+		p.Init()
+		p.PeerID[0] = id
+		p.incoming = true
+		return p
+	}
+
+	a := incoming(40000, 1)
+	if !tor.addIncomingPeer(a) || !a.using {
+		t.Fatal("first connection refused")
+	}
+	// El mismo par desde otro puerto efimero mientras sigue conectado
+	if tor.addIncomingPeer(incoming(40001, 1)) {
+		t.Fatal("accepted a second connection from the same peer")
+	}
+	// Otro cliente detras de la misma IP
+	if !tor.addIncomingPeer(incoming(40002, 2)) {
+		t.Fatal("refused another peer behind the same IP")
+	}
+
+	// Se desconecto y vuelve, reemplaza al viejo
+	a.using = false
+	b := incoming(40003, 1)
+	if !tor.addIncomingPeer(b) {
+		t.Fatal("refused a peer that reconnected")
+	}
+	for _, p := range tor.Peers {
+		if p == a {
+			t.Fatal("the old entry is still there")
+		}
+	}
+	if len(tor.Peers) != 2 {
+		t.Fatalf("%d peers", len(tor.Peers))
+	}
+}
+
+func TestListenerRefusesStoppedTorrent(t *testing.T) {
+	seed, tor, _ := seedSession(t, 22510, nil)
+	defer seed.Close()
+	tor.Stop()
+
+	leech, m := leechFrom(t, 22511, tor, nil)
+	defer leech.Close()
+
+	if waitFor(2*time.Second, func() bool { return m.File.HasInfo() }) {
+		t.Fatal("a stopped torrent sent its metadata")
+	}
+	tor.mutexPeers.RLock()
+	defer tor.mutexPeers.RUnlock()
+	if len(tor.Peers) != 0 {
+		t.Fatalf("a stopped torrent took %d peers", len(tor.Peers))
+	}
+}
@@ -0,0 +1,323 @@
+package libgorrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+)
+
+// EncryptionPolicy Que hacemos con Message Stream Encryption (MSE/PE) en las conexiones con pares
+type EncryptionPolicy int
+
+// El valor cero es el default para que una sesion guardada sin el campo siga igual
+const (
+	// EncryptionDisabled Solo texto plano, como antes
+	EncryptionDisabled EncryptionPolicy = iota
+	// EncryptionPrefer Intentamos MSE y si el par no lo soporta seguimos en texto plano. Aceptamos las dos cosas.
+	EncryptionPrefer
+	// EncryptionRequire Solo conexiones cifradas con RC4
+	EncryptionRequire
+)
+
+const (
+	// msePrimeHex Primo de 768 bits del intercambio Diffie-Hellman, el generador es 2
+	msePrimeHex = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563"
+
+	// mseKeyLength Tamaño de las claves publicas y del secreto compartido
+	mseKeyLength = 96
+
+	// mseMaxPad Los paddings son de 0 a 512 bytes
+	mseMaxPad = 512
+
+	// Metodos de cifrado en crypto_provide y crypto_select
+	mseCryptoPlain = 0x01
+	mseCryptoRC4   = 0x02
+)
+
+var msePrime, _ = new(big.Int).SetString(msePrimeHex, 16)
+
+// mseVC Verification constant, 8 bytes en cero
+var mseVC = make([]byte, 8)
+
+// mseHash HASH() de la especificacion: SHA1 de la concatenacion
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// mseKeys Genera el par de claves Diffie-Hellman. La publica va con padding a 96 bytes.
+func mseKeys() (*big.Int, []byte, error) {
+	x := make([]byte, 20)
+	if _, err := rand.Read(x); err != nil {
+		return nil, nil, err
+	}
+	priv := new(big.Int).SetBytes(x)
+	pub := new(big.Int).Exp(big.NewInt(2), priv, msePrime)
+	return priv, padKey(pub), nil
+}
+
+// mseSecret S = Y ^ X mod P con padding a 96 bytes
+func mseSecret(priv *big.Int, pub []byte) []byte {
+	return padKey(new(big.Int).Exp(new(big.Int).SetBytes(pub), priv, msePrime))
+}
+
+func padKey(n *big.Int) []byte {
+	b := n.Bytes()
+	ret := make([]byte, mseKeyLength)
+	copy(ret[mseKeyLength-len(b):], b)
+	return ret
+}
+
+// mseRC4 RC4 con la clave HASH(name, S, SKEY) descartando los primeros 1024 bytes
+func mseRC4(name string, secret, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// msePad Padding de largo al azar
+func msePad() []byte {
+	n := make([]byte, 2)
+	rand.Read(n)
+	pad := make([]byte, int(binary.BigEndian.Uint16(n))%(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
+
+// mseConn Conexion con el resto del stream cifrado con RC4. Si enc es nil el stream sigue en texto plano.
+type mseConn struct {
+	net.Conn
+	r        io.Reader
+	enc, dec *rc4.Cipher
+	// Datos ya descifrados que hay que devolver primero (el initial payload)
+	pending []byte
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// isPlainHandshake Los primeros bytes de una conexion son un handshake sin cifrar
+func isPlainHandshake(head []byte) bool {
+	return len(head) >= 20 && head[0] == 19 && string(head[1:20]) == "BitTorrent protocol"
+}
+
+// mseInitiate Handshake MSE del lado que se conecta. skey es el info hash del torrent.
+// Devuelve la conexion por la que sigue el handshake de BitTorrent.
+func mseInitiate(conn net.Conn, skey []byte, policy EncryptionPolicy) (*mseConn, error) {
+	priv, pub, err := mseKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(append(pub, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	peerPub := make([]byte, mseKeyLength)
+	if _, err = io.ReadFull(r, peerPub); err != nil {
+		return nil, errors.New("MSE: no public key from peer: " + err.Error())
+	}
+	secret := mseSecret(priv, peerPub)
+
+	enc := mseRC4("keyA", secret, skey)
+	dec := mseRC4("keyB", secret, skey)
+
+	provide := uint32(mseCryptoRC4)
+	if policy == EncryptionPrefer {
+		provide |= mseCryptoPlain
+	}
+
+	var buf bytes.Buffer
+	buf.Write(mseHash([]byte("req1"), secret))
+	req2 := mseHash([]byte("req2"), skey)
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		buf.WriteByte(req2[i] ^ req3[i])
+	}
+	// VC, crypto_provide, len(PadC) y len(IA), sin PadC ni IA
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	enc.XORKeyStream(plain, plain)
+	buf.Write(plain)
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// Buscamos el VC cifrado despues de PadB
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err = mseSync(r, vc, mseMaxPad+len(vc)); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 6)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(head, head)
+	selected := binary.BigEndian.Uint32(head[0:4])
+	padD := make([]byte, binary.BigEndian.Uint16(head[4:6]))
+	if len(padD) > mseMaxPad {
+		return nil, errors.New("MSE: padding too long")
+	}
+	if _, err = io.ReadFull(r, padD); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	switch {
+	case selected == mseCryptoRC4:
+		return &mseConn{Conn: conn, r: r, enc: enc, dec: dec}, nil
+	case selected == mseCryptoPlain && policy == EncryptionPrefer:
+		return &mseConn{Conn: conn, r: r}, nil
+	}
+	return nil, errors.New("MSE: peer selected an unsupported method")
+}
+
+// mseAccept Handshake MSE del lado que recibe la conexion. r ya puede tener bytes leidos de conn.
+// El torrent se identifica por SKEY entre skeys. Devuelve la conexion y el info hash elegido.
+func mseAccept(conn net.Conn, r *bufio.Reader, skeys [][]byte, policy EncryptionPolicy) (*mseConn, []byte, error) {
+	peerPub := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, peerPub); err != nil {
+		return nil, nil, errors.New("MSE: no public key from peer: " + err.Error())
+	}
+
+	priv, pub, err := mseKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = conn.Write(append(pub, msePad()...)); err != nil {
+		return nil, nil, err
+	}
+	secret := mseSecret(priv, peerPub)
+
+	// Despues de PadA viene HASH('req1', S)
+	if err = mseSync(r, mseHash([]byte("req1"), secret), mseMaxPad+sha1.Size); err != nil {
+		return nil, nil, err
+	}
+
+	obfuscated := make([]byte, sha1.Size)
+	if _, err = io.ReadFull(r, obfuscated); err != nil {
+		return nil, nil, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	var skey []byte
+	for _, key := range skeys {
+		req2 := mseHash([]byte("req2"), key)
+		match := true
+		for i := range req2 {
+			if req2[i]^req3[i] != obfuscated[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			skey = key
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, errors.New("MSE: unknown torrent")
+	}
+
+	enc := mseRC4("keyB", secret, skey)
+	dec := mseRC4("keyA", secret, skey)
+
+	head := make([]byte, 14)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(head, head)
+	if !bytes.Equal(head[0:8], mseVC) {
+		return nil, nil, errors.New("MSE: invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(head[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(head[12:14]))
+	if len(padC) > mseMaxPad {
+		return nil, nil, errors.New("MSE: padding too long")
+	}
+	if _, err = io.ReadFull(r, padC); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+
+	iaLen := make([]byte, 2)
+	if _, err = io.ReadFull(r, iaLen); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(iaLen, iaLen)
+	ia := make([]byte, binary.BigEndian.Uint16(iaLen))
+	if _, err = io.ReadFull(r, ia); err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&mseCryptoRC4 != 0:
+		selected = mseCryptoRC4
+	case provide&mseCryptoPlain != 0 && policy == EncryptionPrefer:
+		selected = mseCryptoPlain
+	default:
+		return nil, nil, errors.New("MSE: no common encryption method")
+	}
+
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err = conn.Write(reply); err != nil {
+		return nil, nil, err
+	}
+
+	if selected == mseCryptoPlain {
+		return &mseConn{Conn: conn, r: r, pending: ia}, skey, nil
+	}
+	return &mseConn{Conn: conn, r: r, enc: enc, dec: dec, pending: ia}, skey, nil
+}
+
+// mseSync Lee de r hasta encontrar pattern, que tiene que aparecer en los primeros max bytes
+func mseSync(r *bufio.Reader, pattern []byte, max int) error {
+	var window []byte
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return errors.New("MSE: could not synchronize: " + err.Error())
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("MSE: could not synchronize")
+}
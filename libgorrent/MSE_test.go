@@ -0,0 +1,116 @@
+package libgorrent
+
+import (
+	"testing"
+	"time"
+)
+
+// mseTransports Los casos corren por uTP y por TCP, cada uno con sus puertos
+var mseTransports = []struct {
+	name       string
+	disableUTP bool
+	port       int16
+}{
+	{"utp", false, 0},
+	{"tcp", true, 500},
+}
+
+// mseTransfer Baja el torrent de una sesion a otra por loopback con las politicas dadas.
+// Devuelve el torrent del que baja y si termino.
+func mseTransfer(t *testing.T, port int16, disableUTP bool, seedPolicy, leechPolicy EncryptionPolicy, wait time.Duration) (*Torrent, bool) {
+	seed, tor, data := seedSession(t, port, func(s *Session) {
+		s.Encryption = seedPolicy
+		s.DisableUTP = disableUTP
+	})
+	defer seed.Close()
+
+	leech, m := leechFrom(t, port+1, tor, func(s *Session) {
+		s.Encryption = leechPolicy
+		s.DisableUTP = disableUTP
+	})
+	defer leech.Close()
+
+	return m, waitFor(wait, func() bool { return downloaded(m, data) })
+}
+
+// encryptedPeers Cuantos pares de los que bajamos hablaban cifrado, cuantos en texto plano y cuantos por uTP.
+// Al terminar los dos son seeds y se desconectan, por eso no miramos solo los conectados.
+func encryptedPeers(tor *Torrent) (encrypted, plain, utp int) {
+	tor.mutexPeers.RLock()
+	defer tor.mutexPeers.RUnlock()
+
+	for _, p := range tor.Peers {
+		if p.Downloaded == 0 {
+			continue
+		}
+		if p.Encrypted {
+			encrypted++
+		} else {
+			plain++
+		}
+		if p.UTP {
+			utp++
+		}
+	}
+	return
+}
+
+func TestMSEPolicies(t *testing.T) {
+	cases := []struct {
+		name      string
+		seed      EncryptionPolicy
+		leech     EncryptionPolicy
+		encrypted bool
+	}{
+		{"disabled/disabled", EncryptionDisabled, EncryptionDisabled, false},
+		{"prefer/prefer", EncryptionPrefer, EncryptionPrefer, true},
+		{"require/require", EncryptionRequire, EncryptionRequire, true},
+		{"require/prefer", EncryptionRequire, EncryptionPrefer, true},
+		{"prefer/require", EncryptionPrefer, EncryptionRequire, true},
+		// El que siembra no entiende MSE, el otro vuelve a probar sin cifrar
+		{"disabled/prefer", EncryptionDisabled, EncryptionPrefer, false},
+		{"prefer/disabled", EncryptionPrefer, EncryptionDisabled, false},
+	}
+
+	for _, tr := range mseTransports {
+		for i, c := range cases {
+			tr, c, port := tr, c, int16(22100+10*i)+tr.port
+			t.Run(tr.name+"/"+c.name, func(t *testing.T) {
+				m, ok := mseTransfer(t, port, tr.disableUTP, c.seed, c.leech, 15*time.Second)
+				if !ok {
+					t.Fatalf("download did not finish, %d bytes left", m.Left)
+				}
+				encrypted, plain, utp := encryptedPeers(m)
+				if c.encrypted && (encrypted == 0 || plain > 0) || !c.encrypted && (plain == 0 || encrypted > 0) {
+					t.Fatalf("%d encrypted and %d plaintext peers", encrypted, plain)
+				}
+				if tr.disableUTP && utp > 0 || !tr.disableUTP && utp != encrypted+plain {
+					t.Fatalf("%d of %d peers over uTP", utp, encrypted+plain)
+				}
+			})
+		}
+	}
+}
+
+func TestMSERequireRefusesPlaintext(t *testing.T) {
+	cases := []struct {
+		name  string
+		seed  EncryptionPolicy
+		leech EncryptionPolicy
+	}{
+		{"disabled/require", EncryptionDisabled, EncryptionRequire},
+		{"require/disabled", EncryptionRequire, EncryptionDisabled},
+	}
+
+	for _, tr := range mseTransports {
+		for i, c := range cases {
+			tr, c, port := tr, c, int16(22200+10*i)+tr.port
+			t.Run(tr.name+"/"+c.name, func(t *testing.T) {
+				m, ok := mseTransfer(t, port, tr.disableUTP, c.seed, c.leech, 3*time.Second)
+				if ok || m.File.HasInfo() {
+					t.Fatal("peers with incompatible policies exchanged data")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package libgorrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet Un magnet link ya parseado
+type Magnet struct {
+	InfoHash []byte
+	// dn: nombre para mostrar hasta tener la metadata
+	Name string
+	// tr: cada tracker va en su propio tier
+	Trackers []string
+	// ws: web seeds (BEP 19)
+	WebSeeds []string
+	// x.pe: pares host:puerto para arrancar sin tracker
+	Peers []string
+}
+
+// ParseMagnet Parsea un magnet link con xt=urn:btih en hexa (40 caracteres) o base32 (32 caracteres)
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.New("Invalid magnet link: " + err.Error())
+	}
+	if u.Scheme != "magnet" {
+		return nil, errors.New("Not a magnet link: " + uri)
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, errors.New("Invalid magnet link: " + err.Error())
+	}
+
+	m := &Magnet{}
+	for key, values := range q {
+		switch {
+		case key == "xt" || strings.HasPrefix(key, "xt."):
+			for _, xt := range values {
+				if !strings.HasPrefix(xt, "urn:btih:") {
+					continue
+				}
+				hash, err := parseBTIH(strings.TrimPrefix(xt, "urn:btih:"))
+				if err != nil {
+					return nil, err
+				}
+				m.InfoHash = hash
+			}
+		case key == "dn":
+			m.Name = values[0]
+		case key == "tr" || strings.HasPrefix(key, "tr."):
+			for _, tr := range values {
+				m.Trackers = appendIfMissing(m.Trackers, tr)
+			}
+		case key == "ws":
+			for _, ws := range values {
+				m.WebSeeds = appendIfMissing(m.WebSeeds, ws)
+			}
+		case key == "x.pe":
+			m.Peers = append(m.Peers, values...)
+		}
+	}
+
+	if m.InfoHash == nil {
+		return nil, errors.New("Magnet link without a BitTorrent info hash: " + uri)
+	}
+
+	return m, nil
+}
+
+// parseBTIH Decodifica el info hash de urn:btih
+func parseBTIH(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		hash, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("Invalid hex info hash " + s + ": " + err.Error())
+		}
+		return hash, nil
+	case 32:
+		hash, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return nil, errors.New("Invalid base32 info hash " + s + ": " + err.Error())
+		}
+		return hash, nil
+	}
+	return nil, errors.New("Invalid info hash length " + strconv.Itoa(len(s)))
+}
+
+// TorrentFile Arma un TorrentFile sin diccionario info. Se completa cuando se baja la metadata de los pares.
+func (m *Magnet) TorrentFile() *TorrentFile {
+	tf := &TorrentFile{
+		InfoHash: m.InfoHash,
+	}
+	tf.Info.Name = m.Name
+	if tf.Info.Name == "" {
+		tf.Info.Name = fmt.Sprintf("%X", m.InfoHash)
+	}
+
+	for _, tr := range m.Trackers {
+		tf.RawAnnounceList = append(tf.RawAnnounceList, []string{tr})
+	}
+	if len(m.Trackers) > 0 {
+		tf.Announce = m.Trackers[0]
+	}
+	tf.buildAnnounceTiers()
+	tf.URLList = m.WebSeeds
+
+	return tf
+}
+
+// AddMagnet Agrega un torrent a partir de un magnet link y lo arranca para buscar pares.
+// Hasta que algun par nos manda la metadata el torrent no tiene piezas.
+func (s *Session) AddMagnet(uri string, opts ...TorrentOption) (*Torrent, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := s.AddTorrent(m.TorrentFile(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Si le decimos a los trackers que no falta nada nos toman por seed y no nos mandan seeders
+	t.Left = unknownLeft
+
+	for _, pe := range m.Peers {
+		host, port, err := net.SplitHostPort(pe)
+		if err != nil {
+			log.Println("Invalid magnet peer " + pe + ": " + err.Error())
+			continue
+		}
+		n, err := strconv.Atoi(port)
+		ips, lerr := net.LookupIP(host)
+		if err != nil || lerr != nil || len(ips) == 0 || n <= 0 || n > 65535 {
+			log.Println("Invalid magnet peer " + pe)
+			continue
+		}
+
+		p := &Peer{
+			IP:         ips[0],
+			Port:       uint16(n),
+			Choked:     true,
+			Interested: false,
+		}
+		p.Init()
+		t.addPeer(p)
+	}
+
+	t.Start()
+	return t, nil
+}
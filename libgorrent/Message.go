@@ -0,0 +1,272 @@
+package libgorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MessageID Identificador de cada mensaje del peer wire protocol
+type MessageID byte
+
+// Mensajes definidos en la especificacion (BEP 3)
+const (
+	MsgChoke MessageID = iota
+	MsgUnchoke
+	MsgInterested
+	MsgNotInterested
+	MsgHave
+	MsgBitfield
+	MsgRequest
+	MsgPiece
+	MsgCancel
+	MsgPort
+)
+
+// Mensajes de la Fast Extension (BEP 6)
+const (
+	MsgSuggest MessageID = iota + 0x0D
+	MsgHaveAll
+	MsgHaveNone
+	MsgReject
+	MsgAllowedFast
+)
+
+// MsgExtended Mensaje del protocolo de extensiones (BEP 10)
+const MsgExtended MessageID = 20
+
+// maxMessageLength Ningun cliente razonable manda mensajes mas grandes que esto.
+// Alcanza para un bitfield de ~1M piezas o un bloque de 128 KiB con el id, index y begin.
+const maxMessageLength = 1<<17 + 9
+
+// Message Un mensaje del peer wire protocol ya decodificado.
+// Dependiendo de ID solo algunos campos tienen sentido.
+type Message struct {
+	ID MessageID
+
+	// Have, Request, Piece, Cancel, Suggest, Reject, AllowedFast
+	Index uint32
+	// Request, Piece, Cancel, Reject
+	Begin uint32
+	// Request, Cancel, Reject
+	Length uint32
+	// Bitfield
+	Bitfield Bitfield
+	// Piece
+	Block []byte
+	// Port
+	Port uint16
+	// Extended: id del mensaje extendido, 0 es el handshake
+	Extended byte
+	// Payload crudo de los mensajes que no conocemos
+	Payload []byte
+}
+
+// String TODO
+func (id MessageID) String() string {
+	switch id {
+	case MsgChoke:
+		return "Choke"
+	case MsgUnchoke:
+		return "UnChoke"
+	case MsgInterested:
+		return "Interested"
+	case MsgNotInterested:
+		return "Not Interested"
+	case MsgHave:
+		return "Have"
+	case MsgBitfield:
+		return "Bitfield"
+	case MsgRequest:
+		return "Request"
+	case MsgPiece:
+		return "Piece"
+	case MsgCancel:
+		return "Cancel"
+	case MsgPort:
+		return "Port"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "Have All"
+	case MsgHaveNone:
+		return "Have None"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "Allowed Fast"
+	case MsgExtended:
+		return "Extended"
+	}
+	return fmt.Sprintf("Unknown(%d)", byte(id))
+}
+
+// String TODO
+func (m *Message) String() string {
+	switch m.ID {
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return fmt.Sprintf("%s %d", m.ID, m.Index)
+	case MsgBitfield:
+		return fmt.Sprintf("%s (%d bytes)", m.ID, len(m.Bitfield))
+	case MsgRequest, MsgCancel, MsgReject:
+		return fmt.Sprintf("%s %d:%d+%d", m.ID, m.Index, m.Begin, m.Length)
+	case MsgPiece:
+		return fmt.Sprintf("%s %d:%d+%d", m.ID, m.Index, m.Begin, len(m.Block))
+	case MsgPort:
+		return fmt.Sprintf("%s %d", m.ID, m.Port)
+	case MsgExtended:
+		return fmt.Sprintf("%s %d (%d bytes)", m.ID, m.Extended, len(m.Payload))
+	}
+	return m.ID.String()
+}
+
+// payloadLength Tamaño del payload (sin el id) que ocupa el mensaje
+func (m *Message) payloadLength() int {
+	switch m.ID {
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		return 4
+	case MsgBitfield:
+		return len(m.Bitfield)
+	case MsgRequest, MsgCancel, MsgReject:
+		return 12
+	case MsgPiece:
+		return 8 + len(m.Block)
+	case MsgPort:
+		return 2
+	case MsgExtended:
+		return 1 + len(m.Payload)
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		return 0
+	}
+	return len(m.Payload)
+}
+
+// Encode Serializa el mensaje incluyendo el prefijo de longitud.
+// Un mensaje nil se codifica como Keep Alive.
+func (m *Message) Encode() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+
+	buf := make([]byte, 5+m.payloadLength())
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+m.payloadLength()))
+	buf[4] = byte(m.ID)
+
+	payload := buf[5:]
+	switch m.ID {
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		binary.BigEndian.PutUint32(payload[0:4], m.Index)
+	case MsgBitfield:
+		copy(payload, m.Bitfield)
+	case MsgRequest, MsgCancel, MsgReject:
+		binary.BigEndian.PutUint32(payload[0:4], m.Index)
+		binary.BigEndian.PutUint32(payload[4:8], m.Begin)
+		binary.BigEndian.PutUint32(payload[8:12], m.Length)
+	case MsgPiece:
+		binary.BigEndian.PutUint32(payload[0:4], m.Index)
+		binary.BigEndian.PutUint32(payload[4:8], m.Begin)
+		copy(payload[8:], m.Block)
+	case MsgPort:
+		binary.BigEndian.PutUint16(payload[0:2], m.Port)
+	case MsgExtended:
+		payload[0] = m.Extended
+		copy(payload[1:], m.Payload)
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+	default:
+		copy(payload, m.Payload)
+	}
+
+	return buf
+}
+
+// WriteMessage Escribe el mensaje en w. Un mensaje nil es un Keep Alive.
+func WriteMessage(w io.Writer, m *Message) error {
+	_, err := w.Write(m.Encode())
+	return err
+}
+
+// ReadMessage Lee exactamente un mensaje de r. Devuelve nil, nil si es un Keep Alive.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var l uint32
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+
+	if l == 0 {
+		// Keep Alive
+		return nil, nil
+	}
+
+	if l > maxMessageLength {
+		return nil, fmt.Errorf("Message too long (%d bytes)", l)
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return decodeMessage(data)
+}
+
+// decodeMessage Decodifica un mensaje sin el prefijo de longitud y valida el tamaño del payload
+func decodeMessage(data []byte) (*Message, error) {
+	if len(data) == 0 {
+		return nil, errors.New("Empty message")
+	}
+
+	m := &Message{ID: MessageID(data[0])}
+	payload := data[1:]
+
+	expect := func(n int) error {
+		if len(payload) != n {
+			return fmt.Errorf("Invalid %s message: payload of %d bytes, expected %d", m.ID, len(payload), n)
+		}
+		return nil
+	}
+
+	switch m.ID {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		if err := expect(0); err != nil {
+			return nil, err
+		}
+	case MsgHave, MsgSuggest, MsgAllowedFast:
+		if err := expect(4); err != nil {
+			return nil, err
+		}
+		m.Index = binary.BigEndian.Uint32(payload[0:4])
+	case MsgBitfield:
+		m.Bitfield = Bitfield(payload)
+	case MsgRequest, MsgCancel, MsgReject:
+		if err := expect(12); err != nil {
+			return nil, err
+		}
+		m.Index = binary.BigEndian.Uint32(payload[0:4])
+		m.Begin = binary.BigEndian.Uint32(payload[4:8])
+		m.Length = binary.BigEndian.Uint32(payload[8:12])
+	case MsgPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("Invalid %s message: payload of %d bytes", m.ID, len(payload))
+		}
+		m.Index = binary.BigEndian.Uint32(payload[0:4])
+		m.Begin = binary.BigEndian.Uint32(payload[4:8])
+		m.Block = payload[8:]
+	case MsgPort:
+		if err := expect(2); err != nil {
+			return nil, err
+		}
+		m.Port = binary.BigEndian.Uint16(payload[0:2])
+	case MsgExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("Invalid %s message: empty payload", m.ID)
+		}
+		m.Extended = payload[0]
+		m.Payload = payload[1:]
+	default:
+		// Lo dejamos pasar, puede ser de alguna extension
+		m.Payload = payload
+	}
+
+	return m, nil
+}
@@ -0,0 +1,271 @@
+package libgorrent
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strconv"
+)
+
+const (
+	// metadataPieceSize La metadata se pide en pedazos de 16 KiB (BEP 9)
+	metadataPieceSize = 16 * 1024
+
+	// maxMetadataSize No aceptamos metadata mas grande que esto
+	maxMetadataSize = 1 << 24
+
+	// unknownLeft Lo que le decimos a los trackers que falta mientras no sabemos el tamaño real
+	unknownLeft = metadataPieceSize
+)
+
+// Tipos de mensaje de ut_metadata
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataExtension La extension ut_metadata (BEP 9): intercambio del diccionario info para los magnets
+func metadataExtension() *Extension {
+	return &Extension{
+		Name: "ut_metadata",
+		Extend: func(p *Peer, dict map[string]interface{}) {
+			if size := p.torrent.metadataSize(); size > 0 {
+				dict["metadata_size"] = int64(size)
+			}
+		},
+		Handshake: func(p *Peer, dict map[string]interface{}) error {
+			p.metadataSize = int(dictInt(dict, "metadata_size"))
+			return p.requestMetadata()
+		},
+		Handle: func(p *Peer, payload []byte) error {
+			return p.handleMetadata(payload)
+		},
+	}
+}
+
+// requestMetadata Le pide al par los pedazos de metadata que nos faltan
+func (p *Peer) requestMetadata() error {
+	if p.torrent.File.HasInfo() {
+		return nil
+	}
+
+	for _, piece := range p.torrent.missingMetadata(p.metadataSize) {
+		err := p.SendExtended("ut_metadata", map[string]interface{}{
+			"msg_type": int64(metadataRequest),
+			"piece":    int64(piece),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleMetadata Procesa un mensaje ut_metadata
+func (p *Peer) handleMetadata(payload []byte) error {
+	dict, err := decodeDict(bytes.NewReader(payload))
+	if err != nil {
+		return errors.New("Invalid ut_metadata message: " + err.Error())
+	}
+	piece := int(dictInt(dict, "piece"))
+
+	switch dictInt(dict, "msg_type") {
+	case metadataRequest:
+		data := p.torrent.metadataPiece(piece)
+		if data == nil {
+			return p.SendExtended("ut_metadata", map[string]interface{}{
+				"msg_type": int64(metadataReject),
+				"piece":    int64(piece),
+			}, nil)
+		}
+		return p.SendExtended("ut_metadata", map[string]interface{}{
+			"msg_type":   int64(metadataData),
+			"piece":      int64(piece),
+			"total_size": int64(p.torrent.metadataSize()),
+		}, data)
+
+	case metadataData:
+		total := int(dictInt(dict, "total_size"))
+		length := total - piece*metadataPieceSize
+		if length > metadataPieceSize {
+			length = metadataPieceSize
+		}
+		if piece < 0 || length <= 0 || length > len(payload) {
+			return errors.New("Invalid ut_metadata piece " + strconv.Itoa(piece))
+		}
+		// Los datos vienen despues del diccionario
+		return p.torrent.metadataReceived(p, total, piece, payload[len(payload)-length:])
+
+	case metadataReject:
+		// Puede que el par todavia no la tenga entera, se la pedimos a los demas
+		log.Printf("%21s- Rejected metadata piece %d\n", p, piece)
+		p.torrent.rerequestMetadata(p)
+	}
+
+	return nil
+}
+
+// metadataSize Tamaño del diccionario info, 0 si no lo tenemos
+func (t *Torrent) metadataSize() int {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	return len(t.File.InfoBytes)
+}
+
+// metadataPiece Devuelve el pedazo de metadata para mandarle a un par, o nil si no lo tenemos
+func (t *Torrent) metadataPiece(piece int) []byte {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	info := t.File.InfoBytes
+	begin := piece * metadataPieceSize
+	if piece < 0 || begin >= len(info) {
+		return nil
+	}
+	end := begin + metadataPieceSize
+	if end > len(info) {
+		end = len(info)
+	}
+	return info[begin:end]
+}
+
+// missingMetadata Pedazos de la metadata que todavia no recibimos.
+// size es el tamaño que anuncio el par, si todavia no lo conocemos lo tomamos de ahi.
+func (t *Torrent) missingMetadata(size int) []int {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	if t.File.HasInfo() || !t.initMetadata(size) {
+		return nil
+	}
+
+	var ret []int
+	for i := range t.metadata {
+		if t.metadata[i] == nil {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// initMetadata Prepara los pedazos de metadata a recibir. Se llama con mutexPieces tomado.
+func (t *Torrent) initMetadata(size int) bool {
+	if t.metadata != nil {
+		return true
+	}
+	if size <= 0 || size > maxMetadataSize {
+		return false
+	}
+	t.metadata = make([][]byte, (size+metadataPieceSize-1)/metadataPieceSize)
+	t.metadataTotal = size
+	return true
+}
+
+// metadataReceived Guarda un pedazo de metadata que mando p. Con el ultimo verifica el info hash y arranca la descarga.
+func (t *Torrent) metadataReceived(p *Peer, total, piece int, data []byte) error {
+	t.mutexPieces.Lock()
+	if t.File.HasInfo() {
+		t.mutexPieces.Unlock()
+		return nil
+	}
+	if !t.initMetadata(total) || total != t.metadataTotal || piece >= len(t.metadata) {
+		t.mutexPieces.Unlock()
+		return errors.New("Invalid ut_metadata piece " + strconv.Itoa(piece))
+	}
+
+	t.metadata[piece] = append([]byte(nil), data...)
+	var info []byte
+	for _, d := range t.metadata {
+		if d == nil {
+			t.mutexPieces.Unlock()
+			return nil
+		}
+		info = append(info, d...)
+	}
+	t.metadata = nil
+	t.metadataTotal = 0
+
+	if err := t.File.SetInfo(info); err != nil {
+		// Algun par nos mando basura, empezamos de nuevo con los demas
+		t.mutexPieces.Unlock()
+		log.Printf("%X: %s\n", t.File.InfoHash, err.Error())
+		t.rerequestMetadata(p)
+		return nil
+	}
+
+	err := t.gotMetadata()
+	t.mutexPieces.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s: got metadata, %d pieces\n", t.File.Info.Name, len(t.File.Info.Pieces))
+
+	// Ahora si sabemos que piezas tienen los pares
+	for _, p := range t.connected() {
+		if err := p.updateInterest(); err == nil {
+			p.fillPipeline()
+		}
+	}
+	return nil
+}
+
+// rerequestMetadata Les pide los pedazos de metadata que faltan a los pares conectados que soportan ut_metadata, menos a skip.
+// Los pedidos solo salen en el handshake extendido, sin esto un pedazo rechazado o un hash malo nos deja esperando.
+func (t *Torrent) rerequestMetadata(skip *Peer) {
+	for _, p := range t.connected() {
+		if p == skip || !p.SupportsExtension("ut_metadata") {
+			continue
+		}
+		if err := p.requestMetadata(); err != nil {
+			log.Printf("%21s- %s\n", p, err.Error())
+		}
+	}
+}
+
+// gotMetadata Arma el estado de las piezas con el diccionario info recien bajado. Se llama con mutexPieces tomado.
+func (t *Torrent) gotMetadata() error {
+	t.Bitmap = make([]PieceMap, len(t.File.Info.Pieces))
+	t.downloading = make(map[int]*pieceBuffer)
+	t.picker = NewPiecePicker(t.Bitmap)
+	t.Left = t.File.GetLength()
+
+	t.mutexPeers.RLock()
+	for _, p := range t.Peers {
+		if p.status() != PeerConnected {
+			continue
+		}
+		if p.haveAll {
+			p.Pieces = fullBitfield(len(t.Bitmap))
+			p.haveAll = false
+		}
+		// Los Have sueltos pueden dejarlo mas corto, eso esta bien
+		for len(p.Pieces) < (len(t.Bitmap)+7)/8 {
+			p.Pieces = append(p.Pieces, 0)
+		}
+		if !p.Pieces.valid(len(t.Bitmap)) {
+			log.Printf("%21s Invalid bitfield for %d pieces, ignoring it\n", p, len(t.Bitmap))
+			p.Pieces = nil
+		}
+		t.picker.AddBitfield(p.Pieces)
+	}
+	t.mutexPeers.RUnlock()
+
+	return t.openStorage()
+}
+
+// connected Los pares conectados en este momento
+func (t *Torrent) connected() []*Peer {
+	t.mutexPeers.RLock()
+	defer t.mutexPeers.RUnlock()
+
+	var ret []*Peer
+	for _, p := range t.Peers {
+		if p.status() == PeerConnected {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
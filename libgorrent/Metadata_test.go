@@ -0,0 +1,89 @@
+package libgorrent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// metadataPeer Un par conectado que soporta ut_metadata. Lo que le mandamos queda en el buffer.
+func metadataPeer(t *Torrent, size int) (*Peer, *bytes.Buffer) {
+	var buf bytes.Buffer
+	p := &Peer{Extensions: map[string]int{"ut_metadata": 3}, metadataSize: size}
+	p.Init()
+	p.SetTorrent(t)
+	p.PeerStatus = PeerConnected
+	p.w = bufio.NewWriter(&buf)
+	t.Peers = append(t.Peers, p)
+	return p, &buf
+}
+
+// metadataRequests Los pedazos de metadata que se le pidieron al par
+func metadataRequests(t *testing.T, buf *bytes.Buffer) []int {
+	var ret []int
+	for buf.Len() > 0 {
+		m, err := ReadMessage(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict, err := decodeDict(bytes.NewReader(m.Payload))
+		if err != nil || m.ID != MsgExtended || dictInt(dict, "msg_type") != metadataRequest {
+			t.Fatalf("unexpected message %s", m)
+		}
+		ret = append(ret, int(dictInt(dict, "piece")))
+	}
+	return ret
+}
+
+func TestMetadataRerequest(t *testing.T) {
+	tf, _ := testTorrentFile(t, 300000, 32768)
+	s := testSession(22400)
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%x", tf.InfoHash)
+	tor, err := s.AddMagnet(uri, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := len(tf.InfoBytes)
+	a, bufA := metadataPeer(tor, size)
+	_, bufB := metadataPeer(tor, size)
+
+	// a manda basura, el hash no coincide y se lo pedimos a b
+	bad := bytes.Repeat([]byte{'x'}, size)
+	if err := tor.metadataReceived(a, size, 0, bad); err != nil {
+		t.Fatal(err)
+	}
+	if tor.File.HasInfo() {
+		t.Fatal("took metadata with a bad hash")
+	}
+	if got := metadataRequests(t, bufB); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("asked the other peer for %v", got)
+	}
+	if bufA.Len() != 0 {
+		t.Fatal("asked the peer that sent the bad metadata again")
+	}
+
+	// Si a rechaza tambien vamos a b
+	reject := map[string]interface{}{"msg_type": int64(metadataReject), "piece": int64(0)}
+	var payload bytes.Buffer
+	if err := bencode.Marshal(&payload, reject); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.handleMetadata(payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got := metadataRequests(t, bufB); len(got) != 1 || got[0] != 0 {
+		t.Fatalf("asked the other peer for %v after a reject", got)
+	}
+
+	// Con la metadata buena se termina
+	if err := tor.metadataReceived(a, size, 0, tf.InfoBytes); err != nil {
+		t.Fatal(err)
+	}
+	if !tor.File.HasInfo() {
+		t.Fatal("metadata was not accepted")
+	}
+}
@@ -2,12 +2,14 @@ package libgorrent
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	restruct "gopkg.in/restruct.v1"
@@ -32,9 +34,67 @@ type Peer struct {
 	ErrorReason string
 	PeerID      [20]byte
 
+	// El par esta interesado en nosotros
+	PeerInterested bool
+	// Piezas que anuncio el par
+	Pieces Bitfield
+	// Bits reservados del handshake del par, dicen que extensiones soporta
+	Reserved [8]byte
+	// Puerto DHT que anuncio el par
+	DHTPort uint16
+	// Piezas que el par nos deja pedir aunque nos tenga choked (Fast Extension)
+	AllowedFast Bitfield
+	// Piezas que el par nos sugirio pedir (Fast Extension)
+	Suggested []int
+	// Ids que el par le asigno a cada extension en su handshake extendido (BEP 10)
+	Extensions map[string]int
+	// Cliente y version que anuncio el par (v)
+	Client string
+	// Puerto en el que escucha el par (p), sirve para los pares entrantes
+	ListenPort uint16
+	// Pedidos pendientes que nos acepta el par (reqq)
+	MaxRequests int
+	// Nuestra IP segun el par (yourip)
+	YourIP net.IP
+	// Bytes de piezas recibidos de este par
+	Downloaded int64
+	// Le estamos negando los pedidos al par
+	AmChoking bool
+	// Bytes de piezas enviados a este par
+	Uploaded int64
+	// Velocidades en bytes por segundo, las calcula el choker
+	DownloadRate int64
+	UploadRate   int64
+	// Hace rato que el par no nos manda nada aunque se lo pedimos
+	Snubbed bool
+	// La conexion esta cifrada con MSE
+	Encrypted bool
+	// La conexion es por uTP
+	UTP bool
+
 	// Privates
-	torrent *Torrent
-	using   bool
+	torrent      *Torrent
+	using        bool
+	wmu          sync.Mutex
+	w            *bufio.Writer
+	requests     map[blockRequest]struct{}
+	metadataSize int
+	// Piezas allowed fast que le dimos al par
+	fastSet Bitfield
+	// El par mando Have All antes de que tengamos la metadata
+	haveAll bool
+	// El par se conecto a nosotros, Port no es donde escucha
+	incoming bool
+	// Pares que ya le anunciamos por PEX y cuando nos mando el ultimo mensaje
+	pexSent map[string]struct{}
+	lastPex time.Time
+
+	umu            sync.Mutex
+	uploads        []blockRequest
+	uploadSignal   chan struct{}
+	lastDownloaded int64
+	lastUploaded   int64
+	lastPiece      time.Time
 }
 
 // PeerStatus TODO
@@ -47,6 +107,9 @@ const (
 	PeerError
 )
 
+// peerReadTimeout Si el par no manda nada (ni un Keep Alive) en este tiempo lo damos por muerto
+const peerReadTimeout = 2 * time.Minute
+
 // SetTorrent Funcion que setea el torrent en el tracker. Esta funcion existe para no crear una recursividad en gob
 func (p *Peer) SetTorrent(t *Torrent) {
 	p.torrent = t
@@ -55,6 +118,7 @@ func (p *Peer) SetTorrent(t *Torrent) {
 // Init TODO
 func (p *Peer) Init() error {
 	p.using = false
+	p.AmChoking = true
 	return nil
 }
 
@@ -65,16 +129,117 @@ func (p *Peer) ResumeFromFile() error {
 
 // String TODO
 func (p *Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return p.ConnectAddr()
 }
 
 // ConnectAddr TODO
 func (p *Peer) ConnectAddr() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// Open Se conecta al par. Segun la politica de la sesion negocia MSE antes del handshake.
+func (p *Peer) Open() (net.Conn, error) {
+	p.Encrypted = false
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	policy := p.torrent.session.Encryption
+	if policy == EncryptionDisabled {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ec, err := mseInitiate(conn, p.torrent.File.InfoHash, policy)
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		p.Encrypted = ec.enc != nil
+		return ec, nil
+	}
+	conn.Close()
+
+	if policy == EncryptionRequire {
+		return nil, errors.New("Encrypted connection to " + p.String() + " failed: " + err.Error())
+	}
+	// Puede que el par no soporte MSE, probamos sin cifrar por el mismo transporte que ya sabemos que anda
+	log.Printf("%21s %s, retrying without encryption\n", p, err.Error())
+	if p.UTP {
+		return p.torrent.session.dialUTP(p.ConnectAddr())
+	}
+	return p.dialTCP()
+}
+
+// dialResult Resultado de un intento de conexion por uno de los transportes
+type dialResult struct {
+	conn net.Conn
+	utp  bool
+	err  error
+}
+
+// dial Abre la conexion. Salvo que la sesion lo tenga desactivado empieza por uTP, y si no conecto
+// en utpHeadStart o ya fallo prueba tambien por TCP. Se queda con la primera que conecte.
+func (p *Peer) dial() (net.Conn, error) {
+	s := p.torrent.session
+	if s.DisableUTP {
+		p.UTP = false
+		return p.dialTCP()
+	}
+
+	results := make(chan dialResult, 2)
+	go func() {
+		conn, err := s.dialUTP(p.ConnectAddr())
+		results <- dialResult{conn, true, err}
+	}()
+	pending, tcp := 1, false
+	startTCP := func() {
+		if tcp {
+			return
+		}
+		tcp = true
+		pending++
+		go func() {
+			conn, err := p.dialTCP()
+			results <- dialResult{conn, false, err}
+		}()
+	}
+
+	headStart := time.NewTimer(utpHeadStart)
+	defer headStart.Stop()
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-headStart.C:
+			startTCP()
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if r.utp {
+					log.Printf("%21s %s, trying TCP\n", p, r.err.Error())
+				}
+				err = r.err
+				startTCP()
+				continue
+			}
+
+			p.UTP = r.utp
+			// Si el otro intento tambien conecta no lo necesitamos
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if other := <-results; other.err == nil {
+						other.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, nil
+		}
+	}
+	return nil, err
 }
 
-// Open TODO
-func (p *Peer) Open() (conn net.Conn, err error) {
+// dialTCP Abre la conexion por TCP
+func (p *Peer) dialTCP() (conn net.Conn, err error) {
 	log.Printf("%21s Dial\n", p.ConnectAddr())
 	conn, err = net.DialTimeout("tcp", p.ConnectAddr(), 5*time.Second)
 	if err != nil {
@@ -83,7 +248,6 @@ func (p *Peer) Open() (conn net.Conn, err error) {
 	return
 }
 
-// nolint
 // Connect TODO
 func (p *Peer) Connect() {
 	p.using = true
@@ -94,121 +258,262 @@ func (p *Peer) Connect() {
 	// Open connection to peer
 	conn, err := p.Open()
 	if err != nil {
-		p.PeerStatus = PeerError
+		p.setStatus(PeerError)
 		p.ErrorReason = err.Error()
 		return
 	}
 	defer conn.Close()
 
 	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
-	// r, w := conn.(io.Reader), conn.(io.Writer)
 
 	err = p.doHandshake(r, w)
 	if err != nil {
 		log.Println("Errors during HandShake: ", p, err.Error())
-		p.PeerStatus = PeerError
+		p.setStatus(PeerError)
 		p.ErrorReason = err.Error()
 		return
 	}
-	p.PeerStatus = PeerConnected
 
-	for {
-		if p.PeerStatus == PeerError {
+	p.run(conn, r, w)
+}
+
+// run Atiende la conexion con el par una vez hecho el handshake, sea saliente o entrante
+func (p *Peer) run(conn net.Conn, r *bufio.Reader, w *bufio.Writer) {
+	var err error
+	p.setStatus(PeerConnected)
+
+	p.wmu.Lock()
+	p.w = w
+	p.wmu.Unlock()
+	defer func() {
+		p.wmu.Lock()
+		p.w = nil
+		p.wmu.Unlock()
+		p.Choked = true
+		p.Interested = false
+		p.torrent.releaseRequests(p)
+		p.torrent.peerGone(p)
+	}()
+
+	// Arrancamos choked hasta que se decida lo contrario
+	p.umu.Lock()
+	p.AmChoking = true
+	p.uploads = nil
+	p.fastSet = nil
+	p.uploadSignal = make(chan struct{}, 1)
+	p.lastPiece = time.Now()
+	p.umu.Unlock()
+
+	p.pexSent = nil
+	p.lastPex = time.Time{}
+	p.AllowedFast = nil
+	p.Suggested = nil
+	p.haveAll = false
+
+	done := make(chan struct{})
+	defer close(done)
+	go p.uploader(done)
+
+	if err = p.sendBitfield(); err != nil {
+		p.checkConnStatus(err)
+		return
+	}
+
+	if p.supportsFast() {
+		if err = p.sendAllowedFast(); err != nil {
+			p.checkConnStatus(err)
 			return
 		}
-		// Leo 4 bytes BigEndian
-		var l int32
+	}
 
-		err = conn.SetDeadline(time.Now().Add(2 * time.Second))
-		if err != nil {
-			continue
+	if p.supportsExtensions() {
+		if err = p.sendExtHandshake(); err != nil {
+			p.checkConnStatus(err)
+			return
 		}
+	}
 
-		err := binary.Read(r, binary.BigEndian, &l)
-
-		to, ok := err.(interface{ Timeout() bool })
-		if ok && to.Timeout() {
-			// No me importan los timeouts
-			continue
+	// Si los dos tenemos DHT le decimos en que puerto escuchamos
+	if p.supportsDHT() && p.torrent.session.dht != nil {
+		if err = p.Send(&Message{ID: MsgPort, Port: uint16(p.torrent.session.port)}); err != nil {
+			p.checkConnStatus(err)
+			return
 		}
+	}
 
-		if !p.checkConnStatus(err) {
+	for {
+		if p.status() == PeerError {
 			return
 		}
 
-		if l > 1<<15 {
-			p.PeerStatus = PeerError
+		err = conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+		if err != nil {
+			p.checkConnStatus(err)
 			return
 		}
 
-		if l < 0 {
-			p.PeerStatus = PeerError
+		m, err := ReadMessage(r)
+		if !p.checkConnStatus(err) {
+			if err != io.EOF {
+				p.ErrorReason = err.Error()
+			}
 			return
 		}
 
-		if l == 0 {
+		if m == nil {
 			// Keep Alive
 			// Niice
 			continue
 		}
 
-		var pkg_id byte
-		err = binary.Read(r, binary.BigEndian, &pkg_id)
-		if !p.checkConnStatus(err) {
+		if err = p.handleMessage(m); err != nil {
+			log.Printf("%21s- %s\n", p, err.Error())
+			p.setStatus(PeerError)
+			p.ErrorReason = err.Error()
 			return
 		}
+	}
+}
 
-		switch pkg_id {
-		case 0:
-			log.Printf("%21s- Choke\n", p)
-		case 1:
-			log.Printf("%21s- UnChoke\n", p)
-		case 2:
-			log.Printf("%21s- Interested\n", p)
-		case 3:
-			log.Printf("%21s- Not Interested\n", p)
-		case 4:
-			log.Printf("%21s- Have\n", p)
-		case 5:
-			log.Printf("%21s- Bitfield\n", p)
-		case 6:
-			log.Printf("%21s- Request\n", p)
-		}
-
-		data := make([]byte, r.Buffered())
-		_, err = io.ReadFull(r, data)
-		if !p.checkConnStatus(err) {
-			return
+// handleMessage Procesa un mensaje recibido del par
+func (p *Peer) handleMessage(m *Message) error {
+	log.Printf("%21s- %s\n", p, m)
+
+	switch m.ID {
+	case MsgChoke:
+		p.Choked = true
+		// Los pedidos pendientes se descartan, que los pida otro.
+		// Con la Fast Extension el par nos manda un Reject por cada uno que no va a atender.
+		if !p.supportsFast() {
+			p.torrent.releaseRequests(p)
+		}
+	case MsgUnchoke:
+		p.Choked = false
+		return p.fillPipeline()
+	case MsgInterested:
+		p.PeerInterested = true
+	case MsgNotInterested:
+		p.PeerInterested = false
+	case MsgHave:
+		p.torrent.peerHave(p, int(m.Index))
+		if err := p.updateInterest(); err != nil {
+			return err
+		}
+		return p.fillPipeline()
+	case MsgBitfield:
+		if err := p.torrent.peerBitfield(p, m.Bitfield); err != nil {
+			return err
+		}
+		return p.updateInterest()
+	case MsgPiece:
+		// Una pieza mala no alcanza para cortar, puede tener bloques de otros pares
+		if err := p.torrent.blockReceived(p, m.Index, m.Begin, m.Block); err != nil && err != errHashFailed {
+			return err
 		}
-		log.Printf("%21s- Recv. % X", p.String(), data)
+		p.umu.Lock()
+		p.Downloaded += int64(len(m.Block))
+		p.lastPiece = time.Now()
+		p.umu.Unlock()
+		if err := p.updateInterest(); err != nil {
+			return err
+		}
+		return p.fillPipeline()
+	case MsgRequest:
+		return p.handleRequest(m)
+	case MsgCancel:
+		return p.handleCancel(m)
+	case MsgPort:
+		p.DHTPort = m.Port
+		p.torrent.session.dhtPing(p.IP, m.Port)
+	case MsgSuggest, MsgHaveAll, MsgHaveNone, MsgReject, MsgAllowedFast:
+		return p.handleFast(m)
+	case MsgExtended:
+		return p.handleExtended(m)
+	}
+
+	return nil
+}
+
+// Send Envia un mensaje al par. Un mensaje nil es un Keep Alive.
+func (p *Peer) Send(m *Message) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	if p.w == nil {
+		return errors.New("Peer " + p.String() + " is not connected")
+	}
+
+	if err := WriteMessage(p.w, m); err != nil {
+		return err
 	}
 
+	return p.w.Flush()
 }
 
+// doHandshake Handshake de una conexion saliente: mandamos el nuestro y esperamos el del par
 func (p *Peer) doHandshake(r *bufio.Reader, w *bufio.Writer) error {
-	c := Handshake{
+	err := writeHandshake(w, p.torrent.newHandshake())
+	if err != nil {
+		return err
+	}
+
+	c, err := readHandshake(r)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(c.InfoHash[:], p.torrent.File.InfoHash) {
+		return errors.New("Peer answered with a different info hash")
+	}
+
+	copy(p.PeerID[:], c.PeerID[:20])
+	p.Reserved = c.Reserved
+
+	return nil
+}
+
+// reservedDHT Bit de los reservados del handshake que indica soporte de DHT (BEP 5)
+const reservedDHT = 0x01
+
+// supportsDHT El par anuncio soporte de DHT en el handshake
+func (p *Peer) supportsDHT() bool {
+	return p.Reserved[7]&reservedDHT != 0
+}
+
+// newHandshake Arma nuestro handshake para el torrent
+func (t *Torrent) newHandshake() *Handshake {
+	c := &Handshake{
 		Pstrlen: 19,
 		Pstr:    "BitTorrent protocol",
 	}
 
-	copy(c.InfoHash[:], p.torrent.File.InfoHash[:])
-	copy(c.PeerID[:], p.torrent.session.peerID[:])
+	copy(c.InfoHash[:], t.File.InfoHash[:])
+	copy(c.PeerID[:], t.session.peerID[:])
 
-	d, err := restruct.Pack(binary.BigEndian, &c)
-	if err != nil {
-		return err
+	c.Reserved[5] |= reservedExtension
+	c.Reserved[7] |= reservedFast
+	if t.session.dht != nil {
+		c.Reserved[7] |= reservedDHT
 	}
 
-	_, err = w.Write(d)
+	return c
+}
+
+func writeHandshake(w *bufio.Writer, c *Handshake) error {
+	d, err := restruct.Pack(binary.BigEndian, c)
 	if err != nil {
 		return err
 	}
 
-	err = w.Flush()
+	_, err = w.Write(d)
 	if err != nil {
 		return err
 	}
 
+	return w.Flush()
+}
+
+func readHandshake(r io.Reader) (*Handshake, error) {
 	ret := make([]byte, 49+19)
 	n, err := io.ReadFull(r, ret)
 	if err != nil {
@@ -217,25 +522,41 @@ func (p *Peer) doHandshake(r *bufio.Reader, w *bufio.Writer) error {
 			log.Printf("%+v\n", to.Timeout())
 		}
 		log.Printf("%d %d %s\n", 4, n, err.Error())
-		return err
+		return nil, err
+	}
+
+	if ret[0] != 19 || string(ret[1:20]) != "BitTorrent protocol" {
+		return nil, errors.New("Not a BitTorrent handshake")
 	}
 
-	err = restruct.Unpack(ret, binary.BigEndian, &c)
+	c := &Handshake{}
+	err = restruct.Unpack(ret, binary.BigEndian, c)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	copy(p.PeerID[:], c.PeerID[:20])
+	return c, nil
+}
 
-	return nil
+// status Estado de la conexion. Lo leen el choker y los demas pares, por eso va con umu.
+func (p *Peer) status() PeerStatus {
+	p.umu.Lock()
+	defer p.umu.Unlock()
+	return p.PeerStatus
+}
+
+func (p *Peer) setStatus(s PeerStatus) {
+	p.umu.Lock()
+	p.PeerStatus = s
+	p.umu.Unlock()
 }
 
 func (p *Peer) checkConnStatus(err error) bool {
 	if err != nil {
 		if err == io.EOF {
-			p.PeerStatus = PeerDisconnected
+			p.setStatus(PeerDisconnected)
 		} else {
-			p.PeerStatus = PeerError
+			p.setStatus(PeerError)
 		}
 
 		return false
@@ -0,0 +1,263 @@
+package libgorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// pexInterval BEP 11 pide no mandar mas de un mensaje por minuto
+	pexInterval = time.Minute
+
+	// pexMinInterval Mensajes que llegan mas seguido que esto se ignoran
+	pexMinInterval = 45 * time.Second
+
+	// pexMaxPeers Cantidad maxima de pares agregados o sacados en un mensaje, en cualquier sentido
+	pexMaxPeers = 50
+
+	// pexMaxKnownPeers Dejamos de aceptar pares por PEX cuando el torrent ya conoce tantos
+	pexMaxKnownPeers = 500
+)
+
+// Flags de cada par en added.f (BEP 11)
+const (
+	pexPrefersEncryption = 0x01
+	pexSeed              = 0x02
+	pexUTP               = 0x04
+	pexHolepunch         = 0x08
+	pexReachable         = 0x10
+)
+
+// pexExtension La extension ut_pex (BEP 11). En los torrents privados no se ofrece.
+func pexExtension() *Extension {
+	return &Extension{
+		Name: "ut_pex",
+		Enabled: func(p *Peer) bool {
+			return !p.torrent.File.Info.Private
+		},
+		Handle: func(p *Peer, payload []byte) error {
+			return p.handlePex(payload)
+		},
+	}
+}
+
+// pexLoop GoRoutine que le manda a cada par los cambios en los pares conectados
+func (t *Torrent) pexLoop() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for t.status() != Stopped {
+		<-ticker.C
+		if !t.File.Info.Private {
+			t.sendPex()
+		}
+	}
+}
+
+// pexAddr La direccion en la que se puede conectar al par. Los entrantes solo si anunciaron su puerto.
+func (p *Peer) pexAddr() (string, bool) {
+	port := p.Port
+	if p.incoming {
+		port = p.ListenPort
+	}
+	if port == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(port))), true
+}
+
+// pexFlags Lo que sabemos de un par para anunciarlo
+func (t *Torrent) pexFlags(p *Peer) byte {
+	var flags byte
+	if !p.incoming {
+		flags |= pexReachable
+	}
+	if p.Encrypted {
+		flags |= pexPrefersEncryption
+	}
+	if p.UTP {
+		flags |= pexUTP
+	}
+	if n := len(t.File.Info.Pieces); n > 0 && p.Pieces.Count() >= n {
+		flags |= pexSeed
+	}
+	return flags
+}
+
+// sendPex Manda a cada par que soporta ut_pex los pares que se conectaron y desconectaron desde el ultimo mensaje
+func (t *Torrent) sendPex() {
+	peers := t.connected()
+
+	current := make(map[string]byte)
+	for _, p := range peers {
+		if addr, ok := p.pexAddr(); ok {
+			current[addr] = t.pexFlags(p)
+		}
+	}
+
+	for _, p := range peers {
+		if !p.SupportsExtension("ut_pex") {
+			continue
+		}
+		own, _ := p.pexAddr()
+
+		var added, dropped []string
+		for addr := range current {
+			if _, ok := p.pexSent[addr]; !ok && addr != own && len(added) < pexMaxPeers {
+				added = append(added, addr)
+			}
+		}
+		for addr := range p.pexSent {
+			if _, ok := current[addr]; !ok && len(dropped) < pexMaxPeers {
+				dropped = append(dropped, addr)
+			}
+		}
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		if err := p.SendExtended("ut_pex", encodePex(added, dropped, current), nil); err != nil {
+			continue
+		}
+
+		if p.pexSent == nil {
+			p.pexSent = make(map[string]struct{})
+		}
+		for _, addr := range added {
+			p.pexSent[addr] = struct{}{}
+		}
+		for _, addr := range dropped {
+			delete(p.pexSent, addr)
+		}
+	}
+}
+
+// encodePex Arma el diccionario de ut_pex separando IPv4 de IPv6
+func encodePex(added, dropped []string, flags map[string]byte) map[string]interface{} {
+	var added4, added6, flags4, flags6, dropped4, dropped6 bytes.Buffer
+
+	for _, addr := range added {
+		compact, ipv6 := compactAddr(addr)
+		if compact == nil {
+			continue
+		}
+		if ipv6 {
+			added6.Write(compact)
+			flags6.WriteByte(flags[addr])
+		} else {
+			added4.Write(compact)
+			flags4.WriteByte(flags[addr])
+		}
+	}
+	for _, addr := range dropped {
+		compact, ipv6 := compactAddr(addr)
+		if compact == nil {
+			continue
+		}
+		if ipv6 {
+			dropped6.Write(compact)
+		} else {
+			dropped4.Write(compact)
+		}
+	}
+
+	return map[string]interface{}{
+		"added":    added4.String(),
+		"added.f":  flags4.String(),
+		"added6":   added6.String(),
+		"added6.f": flags6.String(),
+		"dropped":  dropped4.String(),
+		"dropped6": dropped6.String(),
+	}
+}
+
+// compactAddr Formato compacto de host:puerto, 6 bytes para IPv4 y 18 para IPv6
+func compactAddr(addr string) ([]byte, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil, false
+	}
+
+	ipv6 := ip.To4() == nil
+	if !ipv6 {
+		ip = ip.To4()
+	}
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(n))
+	return compact, ipv6
+}
+
+// handlePex Agrega los pares que nos anuncio el par
+func (p *Peer) handlePex(payload []byte) error {
+	if !p.lastPex.IsZero() && time.Since(p.lastPex) < pexMinInterval {
+		// Nos esta inundando, lo ignoramos
+		return nil
+	}
+	p.lastPex = time.Now()
+
+	dict, err := decodeDict(bytes.NewReader(payload))
+	if err != nil {
+		return errors.New("Invalid ut_pex message: " + err.Error())
+	}
+
+	added := dictString(dict, "added")
+	added6 := dictString(dict, "added6")
+	if len(added)%6 != 0 || len(added6)%18 != 0 {
+		return errors.New("Invalid ut_pex peer list")
+	}
+
+	var addrs []*net.TCPAddr
+	for i := 0; i+6 <= len(added); i += 6 {
+		addrs = append(addrs, &net.TCPAddr{
+			IP:   net.IP([]byte(added[i : i+4])),
+			Port: int(binary.BigEndian.Uint16([]byte(added[i+4 : i+6]))),
+		})
+	}
+	for i := 0; i+18 <= len(added6); i += 18 {
+		addrs = append(addrs, &net.TCPAddr{
+			IP:   net.IP([]byte(added6[i : i+16])),
+			Port: int(binary.BigEndian.Uint16([]byte(added6[i+16 : i+18]))),
+		})
+	}
+	if len(addrs) > pexMaxPeers {
+		addrs = addrs[:pexMaxPeers]
+	}
+
+	t := p.torrent
+	for _, addr := range addrs {
+		if addr.Port == 0 || !addr.IP.IsGlobalUnicast() && !addr.IP.IsLoopback() {
+			continue
+		}
+		if addr.Port == int(t.session.port) && p.YourIP.Equal(addr.IP) {
+			// Somos nosotros
+			continue
+		}
+		t.mutexPeers.RLock()
+		known := len(t.Peers)
+		t.mutexPeers.RUnlock()
+		if known >= pexMaxKnownPeers {
+			break
+		}
+
+		peer := &Peer{
+			IP:         addr.IP,
+			Port:       uint16(addr.Port),
+			Choked:     true,
+			Interested: false,
+		}
+		peer.Init()
+		t.addPeer(peer)
+	}
+
+	return nil
+}
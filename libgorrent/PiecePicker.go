@@ -0,0 +1,131 @@
+package libgorrent
+
+import (
+	"math/rand"
+	"time"
+)
+
+// randomFirstPieces Mientras tengamos menos piezas que esto elegimos al azar en vez de la mas rara,
+// asi conseguimos algo para intercambiar lo antes posible
+const randomFirstPieces = 4
+
+// PiecePicker Decide que pieza pedirle a cada par.
+// Mantiene la disponibilidad de cada pieza en PieceMap.Availability a partir de los Bitfield y Have de los pares.
+// No es seguro usarlo desde varias goroutines, el Torrent lo protege con su mutex.
+type PiecePicker struct {
+	pieces  []PieceMap
+	partial map[int]struct{}
+	rnd     *rand.Rand
+}
+
+// NewPiecePicker Crea un picker sobre el bitmap del torrent. El bitmap se comparte, no se copia.
+func NewPiecePicker(pieces []PieceMap) *PiecePicker {
+	return &PiecePicker{
+		pieces:  pieces,
+		partial: make(map[int]struct{}),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// AddBitfield Un par anuncio todas estas piezas
+func (pp *PiecePicker) AddBitfield(b Bitfield) {
+	for i := range pp.pieces {
+		if b.Has(i) {
+			pp.pieces[i].Availability++
+		}
+	}
+}
+
+// RemoveBitfield Un par que tenia estas piezas se fue
+func (pp *PiecePicker) RemoveBitfield(b Bitfield) {
+	for i := range pp.pieces {
+		if b.Has(i) && pp.pieces[i].Availability > 0 {
+			pp.pieces[i].Availability--
+		}
+	}
+}
+
+// AddHave Un par anuncio una pieza nueva
+func (pp *PiecePicker) AddHave(index int) {
+	if index >= 0 && index < len(pp.pieces) {
+		pp.pieces[index].Availability++
+	}
+}
+
+// SetPartial Marca si la pieza esta empezada y todavia le quedan bloques sin pedir
+func (pp *PiecePicker) SetPartial(index int, partial bool) {
+	if partial {
+		pp.partial[index] = struct{}{}
+	} else {
+		delete(pp.partial, index)
+	}
+}
+
+// Pick Elige la proxima pieza para pedirle a un par que tiene has. Devuelve -1 si no hay ninguna.
+// Primero termina las piezas empezadas, despues elige al azar hasta tener randomFirstPieces
+// y a partir de ahi la mas rara, desempatando al azar.
+func (pp *PiecePicker) Pick(has Bitfield) int {
+	if index := pp.pickRarest(has, true); index >= 0 {
+		return index
+	}
+
+	completed := 0
+	for i := range pp.pieces {
+		if pp.pieces[i].Flag == FlagCompleted {
+			completed++
+		}
+	}
+
+	if completed < randomFirstPieces {
+		return pp.pickRandom(has)
+	}
+	return pp.pickRarest(has, false)
+}
+
+// pickRarest Elige la pieza menos disponible entre las empezadas (partial) o las que nadie pidio
+func (pp *PiecePicker) pickRarest(has Bitfield, partial bool) int {
+	best, ties := -1, 0
+	for i := range pp.pieces {
+		if !pp.candidate(i, has, partial) {
+			continue
+		}
+
+		switch {
+		case best < 0 || pp.pieces[i].Availability < pp.pieces[best].Availability:
+			best, ties = i, 1
+		case pp.pieces[i].Availability == pp.pieces[best].Availability:
+			// Reservoir sampling para desempatar
+			ties++
+			if pp.rnd.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// pickRandom Elige cualquier pieza que nadie pidio
+func (pp *PiecePicker) pickRandom(has Bitfield) int {
+	best, n := -1, 0
+	for i := range pp.pieces {
+		if !pp.candidate(i, has, false) {
+			continue
+		}
+		n++
+		if pp.rnd.Intn(n) == 0 {
+			best = i
+		}
+	}
+	return best
+}
+
+func (pp *PiecePicker) candidate(i int, has Bitfield, partial bool) bool {
+	if !has.Has(i) {
+		return false
+	}
+	if partial {
+		_, ok := pp.partial[i]
+		return ok
+	}
+	return pp.pieces[i].Flag == FlagNone
+}
@@ -0,0 +1,116 @@
+package libgorrent
+
+import "testing"
+
+// pickerWith Arma un picker de n piezas con randomFirstPieces ya completas al final,
+// asi Pick deja de elegir al azar
+func pickerWith(n int) (*PiecePicker, []PieceMap) {
+	pieces := make([]PieceMap, n+randomFirstPieces)
+	for i := n; i < len(pieces); i++ {
+		pieces[i].Flag = FlagCompleted
+	}
+	return NewPiecePicker(pieces), pieces
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	pp, _ := pickerWith(4)
+
+	// La pieza 2 la tiene un solo par, las demas tres
+	pp.AddBitfield(Bitfield{0xf0})
+	pp.AddBitfield(Bitfield{0xd0})
+	pp.AddBitfield(Bitfield{0xd0})
+
+	for i := 0; i < 20; i++ {
+		if got := pp.Pick(Bitfield{0xf0}); got != 2 {
+			t.Fatalf("Pick = %d, want the rarest piece 2", got)
+		}
+	}
+
+	// Si el par no la tiene elige entre las otras
+	if got := pp.Pick(Bitfield{0xd0}); got == 2 || got < 0 {
+		t.Fatalf("Pick = %d for a peer without piece 2", got)
+	}
+
+	// Cuando se va el par que la tenia deja de estar disponible y no se elige para los demas
+	pp.RemoveBitfield(Bitfield{0xf0})
+	pp.AddHave(0)
+	if got := pp.Pick(Bitfield{0xd0}); got != 1 && got != 3 {
+		t.Fatalf("Pick = %d, want 1 or 3", got)
+	}
+}
+
+func TestPiecePickerPartialFirst(t *testing.T) {
+	pp, pieces := pickerWith(4)
+	pp.AddBitfield(Bitfield{0xf0})
+	pp.AddBitfield(Bitfield{0xe0})
+	pp.AddBitfield(Bitfield{0xe0})
+
+	// La 0 esta empezada aunque la 3 sea mas rara
+	pieces[0].Flag = FlagRequested
+	pp.SetPartial(0, true)
+	if got := pp.Pick(Bitfield{0xf0}); got != 0 {
+		t.Fatalf("Pick = %d, want the partial piece 0", got)
+	}
+
+	// Ya no le quedan bloques sin pedir
+	pp.SetPartial(0, false)
+	if got := pp.Pick(Bitfield{0xf0}); got != 3 {
+		t.Fatalf("Pick = %d, want the rarest piece 3", got)
+	}
+}
+
+func TestPiecePickerNothing(t *testing.T) {
+	pp, pieces := pickerWith(2)
+	pp.AddBitfield(Bitfield{0xc0})
+	pieces[0].Flag = FlagCompleted
+	pieces[1].Flag = FlagRequested
+
+	if got := pp.Pick(Bitfield{0xc0}); got != -1 {
+		t.Fatalf("Pick = %d, want -1", got)
+	}
+	if got := pp.Pick(nil); got != -1 {
+		t.Fatalf("Pick = %d for an empty bitfield", got)
+	}
+}
+
+func TestPiecePickerRandomFirst(t *testing.T) {
+	pieces := make([]PieceMap, 8)
+	pp := NewPiecePicker(pieces)
+	pp.AddBitfield(Bitfield{0xff})
+	pp.AddBitfield(Bitfield{0x7f})
+
+	// Sin piezas completas elige al azar, tiene que salir alguna que no sea la mas rara
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		seen[pp.Pick(Bitfield{0xff})] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("Pick always returned %v before randomFirstPieces", seen)
+	}
+}
+
+func TestPeerReconnectAvailability(t *testing.T) {
+	tf, _ := testTorrentFile(t, 100000, 32768)
+	tor, err := testSession(6881).AddTorrent(tf, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Peer{}
+	p.SetTorrent(tor)
+
+	// Se conecta, se va y vuelve con las mismas piezas
+	for i := 0; i < 2; i++ {
+		if err := tor.peerBitfield(p, Bitfield{0xc0}); err != nil {
+			t.Fatal(err)
+		}
+		tor.peerHave(p, 3)
+		if i == 0 {
+			tor.peerGone(p)
+		}
+	}
+	for i, want := range []int32{1, 1, 0, 1} {
+		if got := tor.Bitmap[i].Availability; got != want {
+			t.Fatalf("availability of piece %d is %d, want %d", i, got, want)
+		}
+	}
+}
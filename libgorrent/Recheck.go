@@ -0,0 +1,95 @@
+package libgorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Recheck Lee los datos que ya hay en el storage, verifica el hash de todas las piezas en paralelo
+// y reconstruye Bitmap, Downloaded y Left. Devuelve las piezas que faltan o estan mal.
+// El torrent no puede estar corriendo mientras se verifica.
+func (t *Torrent) Recheck() ([]int, error) {
+	if t.status() != Stopped {
+		// Sembrando (Completed) tambien esta corriendo, el choker y los uploaders usan el Bitmap
+		return nil, errors.New("Cannot recheck a running torrent")
+	}
+	if t.storage == nil {
+		return nil, errors.New("Torrent has no storage")
+	}
+
+	npieces := len(t.File.Info.Pieces)
+	good := make([]bool, npieces)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				good[index] = t.verifyPiece(index)
+			}
+		}()
+	}
+	for i := 0; i < npieces; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	var bad []int
+	var have int64
+	t.downloading = make(map[int]*pieceBuffer)
+	t.picker = NewPiecePicker(t.Bitmap)
+	for i := range good {
+		if good[i] {
+			t.Bitmap[i].Flag = FlagCompleted
+			have += t.File.GetPieceLength(i)
+		} else {
+			t.Bitmap[i].Flag = FlagNone
+			bad = append(bad, i)
+		}
+	}
+	t.Downloaded = have
+	t.Left = t.File.GetLength() - have
+
+	return bad, nil
+}
+
+// verifyPiece Lee la pieza del storage y compara su hash. Si no se puede leer se considera mala.
+func (t *Torrent) verifyPiece(index int) bool {
+	data, err := t.readBlock(index, 0, int(t.File.GetPieceLength(index)))
+	if err != nil {
+		return false
+	}
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], t.File.Info.Pieces[index])
+}
+
+// HasData Ya hay algun archivo del torrent en Location, hay que verificarlo antes de bajar
+func (t *Torrent) HasData() bool {
+	if !t.File.HasInfo() || t.Backend == MemoryStorage {
+		return false
+	}
+	base := t.Location
+	if base == "" {
+		base = "."
+	}
+	for _, f := range t.File.GetFiles() {
+		path, err := storagePath(base, f)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
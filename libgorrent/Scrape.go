@@ -0,0 +1,156 @@
+package libgorrent
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ScrapeURL Deriva la URL de scrape a partir de la de announce (BEP 48).
+// Solo se puede si el ultimo componente del path empieza con "announce". El query queda igual.
+func (tr *Tracker) ScrapeURL() (string, error) {
+	u, err := url.Parse(tr.URL)
+	if err != nil {
+		return "", errors.New("Invalid tracker URL " + tr.URL + ": " + err.Error())
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", errors.New("Tracker " + tr.URL + " does not support scrape")
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// Scrape Pide el estado del swarm de uno o varios info hashes en un solo pedido.
+// Sin info hashes usa el del torrent del tracker. El resultado esta indexado por info hash.
+func (tr *Tracker) Scrape(hashes ...[]byte) (map[string]ScrapeResult, error) {
+	if len(hashes) == 0 {
+		if tr.torrent == nil {
+			return nil, errors.New("No info hash to scrape")
+		}
+		hashes = [][]byte{tr.torrent.File.InfoHash}
+	}
+
+	switch {
+	case strings.HasPrefix(tr.URL, "http"):
+		return tr.scrapeHTTP(hashes)
+	case strings.HasPrefix(tr.URL, "udp"):
+		ret := make(map[string]ScrapeResult)
+		// El protocolo UDP tiene un limite de info hashes por pedido
+		for len(hashes) > 0 {
+			n := len(hashes)
+			if n > udpMaxScrape {
+				n = udpMaxScrape
+			}
+			res, err := tr.scrapeUDP(hashes[:n])
+			if err != nil {
+				return nil, err
+			}
+			for i := range res {
+				ret[string(hashes[i])] = res[i]
+			}
+			hashes = hashes[n:]
+		}
+		return ret, nil
+	}
+
+	return nil, errors.New("Protocol not supported " + tr.URL)
+}
+
+func (tr *Tracker) scrapeHTTP(hashes [][]byte) (map[string]ScrapeResult, error) {
+	scrapeURL, err := tr.ScrapeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, errors.New("Invalid scrape URL " + scrapeURL + ": " + err.Error())
+	}
+	q := u.Query()
+	for _, h := range hashes {
+		q.Add("info_hash", string(h))
+	}
+	u.RawQuery = q.Encode()
+
+	client := &http.Client{Timeout: trackerHTTPTimeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, errors.New("Errored when sending scrape to the server: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	res, err := decodeDict(resp.Body)
+	if err != nil {
+		return nil, errors.New("Cannot decode scrape response. " + err.Error())
+	}
+
+	if reason := dictString(res, "failure reason"); reason != "" {
+		return nil, errors.New("Tracker " + tr.URL + " failed: " + reason)
+	}
+
+	files, _ := res["files"].(map[string]interface{})
+	ret := make(map[string]ScrapeResult)
+	for hash, x := range files {
+		stats, ok := x.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ret[hash] = ScrapeResult{
+			Complete:   dictInt(stats, "complete"),
+			Downloaded: dictInt(stats, "downloaded"),
+			Incomplete: dictInt(stats, "incomplete"),
+		}
+	}
+	return ret, nil
+}
+
+// Scrape Estado del swarm de cada torrent de la sesion, indexado por info hash.
+// Los torrents que comparten tracker se piden juntos y todos los trackers se consultan en paralelo.
+// Si varios trackers responden por el mismo torrent se queda con el que ve mas pares.
+func (s *Session) Scrape() map[string]ScrapeResult {
+	// Agrupo los torrents por tracker
+	byURL := make(map[string][][]byte)
+	trackers := make(map[string]*Tracker)
+	for _, t := range s.AllTorrents {
+		for _, tr := range t.Trackers {
+			if _, ok := trackers[tr.URL]; !ok {
+				trackers[tr.URL] = tr
+			}
+			byURL[tr.URL] = append(byURL[tr.URL], t.File.InfoHash)
+		}
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	ret := make(map[string]ScrapeResult)
+	for u, tr := range trackers {
+		wg.Add(1)
+		go func(tr *Tracker, hashes [][]byte) {
+			defer wg.Done()
+
+			res, err := tr.Scrape(hashes...)
+			if err != nil {
+				log.Println(err.Error())
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for h, r := range res {
+				old, ok := ret[h]
+				if !ok || r.Complete+r.Incomplete > old.Complete+old.Incomplete {
+					ret[h] = r
+				}
+			}
+		}(tr, byURL[u])
+	}
+	wg.Wait()
+
+	return ret
+}
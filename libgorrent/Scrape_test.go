@@ -0,0 +1,20 @@
+package libgorrent
+
+import "testing"
+
+func TestScrapeURL(t *testing.T) {
+	cases := map[string]string{
+		"http://t.example/announce":             "http://t.example/scrape",
+		"http://t.example/x/announce.php?k=1":   "http://t.example/x/scrape.php?k=1",
+		"http://t.example/announce?passkey=a/b": "http://t.example/scrape?passkey=a/b",
+		"udp://t.example:80/announce":           "udp://t.example:80/scrape",
+		"http://t.example/a?x=announce":         "",
+		"http://t.example/announce/other":       "",
+	}
+	for in, want := range cases {
+		got, err := (&Tracker{URL: in}).ScrapeURL()
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("ScrapeURL(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
@@ -6,16 +6,41 @@ import (
 	"encoding/gob"
 	"errors"
 	"log"
+	"net"
 	"os"
+	"sync"
 )
 
 // Session TODO
 type Session struct {
 	AllTorrents []*Torrent
+	// Cantidad de pares que atiende cada torrent a la vez, salvo que el torrent diga otra cosa
+	UploadSlots int
+	// IP que se le anuncia a los trackers (parametro ip). Vacio para que usen la de origen.
+	AnnounceIP string
+	// IPv6 que se le anuncia a los trackers (parametro ipv6). Vacio para detectarla sola.
+	AnnounceIPv6 string
+	// Encryption Politica de Message Stream Encryption con los pares
+	Encryption EncryptionPolicy
+	// DisableUTP Solo TCP con los pares. Si no, primero probamos uTP y si no contesta TCP.
+	DisableUTP bool
+	// DHTBootstrap Nodos host:puerto para entrar a la DHT. Vacio para usar los conocidos.
+	DHTBootstrap []string
+	// DHTNodeID ID de nuestro nodo DHT, se mantiene entre sesiones
+	DHTNodeID []byte
+	// DHTNodes Tabla de ruteo de la DHT al momento de guardar la sesion
+	DHTNodes []DHTNodeInfo
 
 	// Privates
-	port   int16
-	peerID []byte
+	port        int16
+	peerID      []byte
+	listener    net.Listener
+	utpListener net.Listener
+	udp         *udpMux
+	udpMutex    sync.Mutex
+	dht         *DHT
+	lsd         *lsd
+	extensions  []*Extension
 }
 
 func generateRandomBytes(n int) []byte {
@@ -29,10 +54,18 @@ func NewSession() (*Session, error) {
 
 	PeerID := "-GOR000-" + randStringBytesMaskImprSrcUnsafe(20-len("-GOR000-"))
 
-	return &Session{
-		peerID: []byte(PeerID),
-		port:   1337, // Deberia venir de alguna config
-	}, nil
+	s := &Session{
+		peerID:      []byte(PeerID),
+		port:        1337, // Deberia venir de alguna config
+		UploadSlots: defaultUploadSlots,
+	}
+	for _, e := range []*Extension{metadataExtension(), pexExtension()} {
+		if err := s.RegisterExtension(e); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
 }
 
 // NewSessionFromFile TODO
@@ -83,7 +116,7 @@ func (s *Session) Debug() {
 }
 
 // AddTorrent TODO
-func (s *Session) AddTorrent(tor *TorrentFile) (*Torrent, error) {
+func (s *Session) AddTorrent(tor *TorrentFile, opts ...TorrentOption) (*Torrent, error) {
 	// Me fijo si el InfoHash no fue agregado anteriormente
 
 	for _, torrent := range s.AllTorrents {
@@ -102,15 +135,71 @@ func (s *Session) AddTorrent(tor *TorrentFile) (*Torrent, error) {
 		Trackers:   make([]*Tracker, 0),
 	}
 
+	for _, opt := range opts {
+		opt(aNewTorrent)
+	}
+
 	aNewTorrent.SetSession(s)
-	aNewTorrent.Init()
+	if err := aNewTorrent.Init(); err != nil {
+		return nil, err
+	}
 
 	s.AllTorrents = append(s.AllTorrents, aNewTorrent)
 	return aNewTorrent, nil
 }
 
+// Close Detiene todos los torrents avisandole a los trackers y deja de aceptar conexiones
+func (s *Session) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.utpListener != nil {
+		s.utpListener.Close()
+	}
+	if s.dht != nil {
+		s.dht.Close()
+	}
+	s.udpMutex.Lock()
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	s.udpMutex.Unlock()
+	if s.lsd != nil {
+		s.lsd.close()
+	}
+	for _, t := range s.AllTorrents {
+		t.Stop()
+	}
+}
+
+// announceIPv6 Devuelve la IPv6 que le anunciamos a los trackers, o nil si no tenemos una publica
+func (s *Session) announceIPv6() net.IP {
+	if s.AnnounceIPv6 != "" {
+		return net.ParseIP(s.AnnounceIPv6)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil {
+			continue
+		}
+		if ipnet.IP.IsGlobalUnicast() && !ipnet.IP.IsPrivate() {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
 // Save TODO
 func (s *Session) Save() error {
+	if s.dht != nil {
+		s.DHTNodes = s.dht.Nodes()
+	}
+
 	var data bytes.Buffer
 	enc := gob.NewEncoder(&data)
 	err := enc.Encode(s)
@@ -119,7 +208,7 @@ func (s *Session) Save() error {
 		return err
 	}
 
-	f, err := os.OpenFile("session.gob", os.O_RDWR|os.O_CREATE, 0755)
+	f, err := os.OpenFile("session.gob", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		log.Printf("Could not persist session.\n")
 		return err
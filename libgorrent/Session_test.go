@@ -0,0 +1,119 @@
+package libgorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// testTorrentFile Arma un torrent de dos archivos con datos al azar, como si viniera de un .torrent
+func testTorrentFile(t *testing.T, length int64, pieceLength int) (*TorrentFile, []byte) {
+	data := make([]byte, length)
+	rand.Read(data)
+
+	var pieces []byte
+	for off := int64(0); off < length; off += int64(pieceLength) {
+		end := off + int64(pieceLength)
+		if end > length {
+			end = length
+		}
+		hash := sha1.Sum(data[off:end])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := map[string]interface{}{
+		"name":         "x",
+		"piece length": int64(pieceLength),
+		"pieces":       string(pieces),
+		"files": []interface{}{
+			map[string]interface{}{"length": length / 3, "path": []interface{}{"a"}},
+			map[string]interface{}{"length": length - length/3, "path": []interface{}{"d", "b"}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, info); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha1.Sum(buf.Bytes())
+	tf := &TorrentFile{InfoHash: hash[:]}
+	if err := tf.SetInfo(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return tf, data
+}
+
+// testSession Una sesion en el puerto port que no guarda nada en disco
+func testSession(port int16) *Session {
+	s, _ := NewSession()
+	s.port = port
+	return s
+}
+
+// seedSession Una sesion escuchando en port que siembra un torrent completo en memoria.
+// opt se aplica a la sesion antes de arrancar.
+func seedSession(t *testing.T, port int16, opt func(*Session)) (*Session, *Torrent, []byte) {
+	tf, data := testTorrentFile(t, 300000, 32768)
+	s := testSession(port)
+	if opt != nil {
+		opt(s)
+	}
+
+	tor, err := s.AddTorrent(tf, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tor.storage.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if bad, err := tor.Recheck(); err != nil || len(bad) > 0 {
+		t.Fatal("seed data is not complete", bad, err)
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	tor.Start()
+	return s, tor, data
+}
+
+// leechFrom Una sesion en port que baja el torrent de seed con un magnet que apunta directo a el
+func leechFrom(t *testing.T, port int16, seed *Torrent, opt func(*Session)) (*Session, *Torrent) {
+	s := testSession(port)
+	if opt != nil {
+		opt(s)
+	}
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%x&x.pe=127.0.0.1:%d", seed.File.InfoHash, seed.session.port)
+	tor, err := s.AddMagnet(uri, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tor
+}
+
+// waitFor Espera hasta que cond sea cierto o pase timeout
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for end := time.Now().Add(timeout); time.Now().Before(end); time.Sleep(50 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// downloaded Ya bajo todo y coincide con data
+func downloaded(tor *Torrent, data []byte) bool {
+	tor.mutexPieces.Lock()
+	defer tor.mutexPieces.Unlock()
+
+	if tor.storage == nil || tor.Left != 0 || !tor.File.HasInfo() {
+		return false
+	}
+	got := make([]byte, len(data))
+	tor.storage.ReadAt(got, 0)
+	return bytes.Equal(got, data)
+}
@@ -0,0 +1,219 @@
+package libgorrent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Storage Donde se guardan los datos de un torrent.
+// Los offsets son relativos al torrent completo, como si todos los archivos de GetFiles() estuvieran concatenados.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// StorageBackend Implementacion de Storage que usa un torrent
+type StorageBackend int
+
+// TODO
+const (
+	// FileStorage Archivos comunes debajo de Torrent.Location
+	FileStorage StorageBackend = iota
+	// MemoryStorage Todo en memoria, no toca el disco
+	MemoryStorage
+	// MmapStorage Archivos debajo de Torrent.Location mapeados en memoria (solo Linux)
+	MmapStorage
+)
+
+// fileSegment Un pedazo de un archivo dentro del torrent
+type fileSegment struct {
+	// Indice en GetFiles()
+	File int
+	// Offset dentro del archivo
+	Offset int64
+	Length int64
+}
+
+// locate Traduce un rango del torrent completo a los pedazos de archivo que lo componen.
+// Un rango puede cruzar varios archivos.
+func locate(files []File, off, length int64) []fileSegment {
+	var ret []fileSegment
+	var start int64
+	for i, f := range files {
+		end := start + f.Length
+		if length <= 0 {
+			break
+		}
+		if off < end {
+			seg := fileSegment{
+				File:   i,
+				Offset: off - start,
+				Length: end - off,
+			}
+			if seg.Length > length {
+				seg.Length = length
+			}
+			ret = append(ret, seg)
+			off += seg.Length
+			length -= seg.Length
+		}
+		start = end
+	}
+	return ret
+}
+
+// storagePath Arma el path del archivo dentro de base, sin dejar que se escape del directorio
+func storagePath(base string, f File) (string, error) {
+	clean := filepath.Clean(f.Path)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("Invalid path in torrent: " + f.Path)
+	}
+	return filepath.Join(base, clean), nil
+}
+
+// fileStorage Guarda los datos en archivos comunes debajo de base
+type fileStorage struct {
+	base  string
+	files []File
+
+	mutex    sync.Mutex
+	handles  []*os.File
+	writable []bool
+}
+
+func newFileStorage(base string, t *TorrentFile) *fileStorage {
+	if base == "" {
+		base = "."
+	}
+	files := t.GetFiles()
+	return &fileStorage{
+		base:     base,
+		files:    files,
+		handles:  make([]*os.File, len(files)),
+		writable: make([]bool, len(files)),
+	}
+}
+
+// open Abre el archivo i. Para escribir lo crea junto con sus directorios.
+func (s *fileStorage) open(i int, write bool) (*os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.handles[i] != nil && (s.writable[i] || !write) {
+		return s.handles[i], nil
+	}
+
+	path, err := storagePath(s.base, s.files[i])
+	if err != nil {
+		return nil, err
+	}
+
+	var f *os.File
+	if write {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		// Si se puede lo abrimos para escritura asi no hay que reabrirlo despues
+		f, err = os.OpenFile(path, os.O_RDWR, 0)
+		write = err == nil
+		if os.IsPermission(err) {
+			f, err = os.Open(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.handles[i] != nil {
+		s.handles[i].Close()
+	}
+	s.handles[i] = f
+	s.writable[i] = write
+	return f, nil
+}
+
+// ReadAt TODO
+func (s *fileStorage) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for _, seg := range locate(s.files, off, int64(len(b))) {
+		f, err := s.open(seg.File, false)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.ReadAt(b[n:int64(n)+seg.Length], seg.Offset)
+		n += m
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt TODO
+func (s *fileStorage) WriteAt(b []byte, off int64) (int, error) {
+	n := 0
+	for _, seg := range locate(s.files, off, int64(len(b))) {
+		f, err := s.open(seg.File, true)
+		if err != nil {
+			return n, err
+		}
+		m, err := f.WriteAt(b[n:int64(n)+seg.Length], seg.Offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(b) {
+		return n, errors.New("Write past the end of the torrent")
+	}
+	return n, nil
+}
+
+// Close TODO
+func (s *fileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ret error
+	for i, f := range s.handles {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && ret == nil {
+			ret = err
+		}
+		s.handles[i] = nil
+		s.writable[i] = false
+	}
+	return ret
+}
+
+// readBlock Lee length bytes de la pieza index a partir de begin
+func (t *Torrent) readBlock(index int, begin int64, length int) ([]byte, error) {
+	data := make([]byte, length)
+	off := int64(index)*int64(t.File.Info.PieceLength) + begin
+	if _, err := t.storage.ReadAt(data, off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeBlock Escribe data en la pieza index a partir de begin
+func (t *Torrent) writeBlock(index int, begin int64, data []byte) error {
+	off := int64(index)*int64(t.File.Info.PieceLength) + begin
+	_, err := t.storage.WriteAt(data, off)
+	return err
+}
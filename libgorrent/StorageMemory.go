@@ -0,0 +1,79 @@
+package libgorrent
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// memoryChunkSize Los datos en memoria se guardan en pedazos de este tamaño a medida que se escriben
+const memoryChunkSize = 1 << 20
+
+// memoryStorage Guarda todo en memoria. Sirve para tests y para streaming sin tocar el disco.
+type memoryStorage struct {
+	length int64
+
+	mutex  sync.RWMutex
+	chunks map[int64][]byte
+}
+
+func newMemoryStorage(t *TorrentFile) *memoryStorage {
+	return &memoryStorage{
+		length: t.GetLength(),
+		chunks: make(map[int64][]byte),
+	}
+}
+
+// ReadAt TODO
+func (s *memoryStorage) ReadAt(b []byte, off int64) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= s.length {
+			return n, io.EOF
+		}
+		chunk, ok := s.chunks[pos/memoryChunkSize]
+		if !ok {
+			return n, errors.New("Data not present in memory")
+		}
+		n += copy(b[n:], chunk[pos%memoryChunkSize:])
+	}
+	return n, nil
+}
+
+// WriteAt TODO
+func (s *memoryStorage) WriteAt(b []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= s.length {
+			return n, errors.New("Write past the end of the torrent")
+		}
+		chunk, ok := s.chunks[pos/memoryChunkSize]
+		if !ok {
+			size := s.length - pos/memoryChunkSize*memoryChunkSize
+			if size > memoryChunkSize {
+				size = memoryChunkSize
+			}
+			chunk = make([]byte, size)
+			s.chunks[pos/memoryChunkSize] = chunk
+		}
+		n += copy(chunk[pos%memoryChunkSize:], b[n:])
+	}
+	return n, nil
+}
+
+// Close TODO
+func (s *memoryStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.chunks = make(map[int64][]byte)
+	return nil
+}
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package libgorrent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// mmapStorage Mapea cada archivo del torrent en memoria. Conviene para torrents grandes.
+type mmapStorage struct {
+	files []File
+	maps  [][]byte
+}
+
+func newMmapStorage(base string, t *TorrentFile) (Storage, error) {
+	if base == "" {
+		base = "."
+	}
+
+	s := &mmapStorage{
+		files: t.GetFiles(),
+	}
+	s.maps = make([][]byte, len(s.files))
+
+	for i, file := range s.files {
+		path, err := storagePath(base, file)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		if file.Length == 0 {
+			f.Close()
+			continue
+		}
+
+		if err = f.Truncate(file.Length); err != nil {
+			f.Close()
+			s.Close()
+			return nil, err
+		}
+
+		data, err := syscall.Mmap(int(f.Fd()), 0, int(file.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		// El mapeo sigue siendo valido despues de cerrar el archivo
+		f.Close()
+		if err != nil {
+			s.Close()
+			return nil, errors.New("Could not mmap " + path + ": " + err.Error())
+		}
+		s.maps[i] = data
+	}
+
+	return s, nil
+}
+
+// ReadAt TODO
+func (s *mmapStorage) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for _, seg := range locate(s.files, off, int64(len(b))) {
+		n += copy(b[n:int64(n)+seg.Length], s.maps[seg.File][seg.Offset:])
+	}
+	if n < len(b) {
+		return n, errors.New("Read past the end of the torrent")
+	}
+	return n, nil
+}
+
+// WriteAt TODO
+func (s *mmapStorage) WriteAt(b []byte, off int64) (int, error) {
+	n := 0
+	for _, seg := range locate(s.files, off, int64(len(b))) {
+		n += copy(s.maps[seg.File][seg.Offset:seg.Offset+seg.Length], b[n:])
+	}
+	if n < len(b) {
+		return n, errors.New("Write past the end of the torrent")
+	}
+	return n, nil
+}
+
+// Close TODO
+func (s *mmapStorage) Close() error {
+	var ret error
+	for i, data := range s.maps {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && ret == nil {
+			ret = err
+		}
+		s.maps[i] = nil
+	}
+	return ret
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package libgorrent
+
+import "errors"
+
+func newMmapStorage(base string, t *TorrentFile) (Storage, error) {
+	return nil, errors.New("Mmap storage is only supported on Linux")
+}
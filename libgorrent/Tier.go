@@ -0,0 +1,69 @@
+package libgorrent
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// announceTier GoRoutine que hace announce a un solo tracker del tier (BEP 12).
+// Prueba los trackers en orden y el primero que responde pasa al frente del tier.
+// El primer announce lleva el evento started, y los eventos que lleguen por tierEvents se mandan en el siguiente.
+func (t *Torrent) announceTier(tier int) {
+	event := EventStarted
+	for t.status() != Stopped {
+		wait := trackerRetryInterval
+
+		tr, err := t.tierAnnounce(tier, event)
+		if err != nil {
+			log.Println(err.Error())
+		} else {
+			event = EventNone
+			wait = tr.nextAnnounce()
+		}
+
+		select {
+		case ev := <-t.tierEvents[tier]:
+			if ev != EventNone {
+				event = ev
+			}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tierAnnounce Hace announce al primer tracker del tier que responda y lo promueve al frente
+func (t *Torrent) tierAnnounce(tier int, event TrackerEvent) (*Tracker, error) {
+	trackers := t.Tiers[tier]
+	retries := udpMaxRetries
+	if len(trackers) > 1 {
+		// Si hay otro tracker para probar no esperamos tanto a este
+		retries = udpTierRetries
+	}
+	for i, tr := range trackers {
+		if err := tr.announce(event, retries); err != nil {
+			log.Println(err.Error())
+			tr.LastError = err.Error()
+			tr.Status = Error
+			continue
+		}
+
+		if i > 0 {
+			copy(trackers[1:i+1], trackers[0:i])
+			trackers[0] = tr
+		}
+		return tr, nil
+	}
+
+	return nil, errors.New("No tracker in tier answered")
+}
+
+// tierEvent Le pasa un evento a todos los announcers
+func (t *Torrent) tierEvent(event TrackerEvent) {
+	for _, ch := range t.tierEvents {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
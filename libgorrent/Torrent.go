@@ -33,8 +33,9 @@ const (
 
 // PieceMap TODO
 type PieceMap struct {
-	Flag         BitmapFlags
-	Availability int8
+	Flag BitmapFlags
+	// Cantidad de pares conectados que tienen la pieza
+	Availability int32
 }
 
 // Torrent TODO
@@ -46,28 +47,70 @@ type Torrent struct {
 	Left       int64
 	Status     StatusEnum
 	Trackers   []*Tracker
+	// Tiers Los mismos trackers de Trackers agrupados por tier (BEP 12)
+	Tiers      [][]*Tracker
 	Peers      []*Peer
 	Bitmap     []PieceMap
 	BitmapChan chan int64
+	Backend    StorageBackend
+	// Endgame Ya se pidieron todos los bloques que faltan, los pedimos a todos los pares que los tengan
+	Endgame bool
+	// UploadSlots Cantidad de pares que atendemos a la vez. Si es 0 se usa el de la Session.
+	UploadSlots int
 
 	//Privates
-	session       *Session
-	mutexPeers    sync.RWMutex
+	session     *Session
+	mutexPeers  sync.RWMutex
+	mutexPieces sync.Mutex
+	downloading map[int]*pieceBuffer
+	storage     Storage
+	picker      *PiecePicker
+	optimistic  *Peer
+	tierEvents  []chan TrackerEvent
+	// Pedazos de metadata recibidos mientras no tenemos el diccionario info (BEP 9)
+	metadata      [][]byte
+	metadataTotal int
 	peersAvailIn  chan<- *Peer
 	peersAvailOut <-chan *Peer
+	// webSeeds Las web seeds que estan bajando, sus pares virtuales no estan en Peers
+	webSeeds []*webSeed
 	// peersConnected chan interface{}
 }
 
+// TorrentOption Opciones que se le pueden pasar a Session.AddTorrent
+type TorrentOption func(*Torrent)
+
+// WithStorage Elige donde se guardan los datos del torrent
+func WithStorage(backend StorageBackend) TorrentOption {
+	return func(t *Torrent) {
+		t.Backend = backend
+	}
+}
+
+// WithLocation Directorio donde se guardan los archivos del torrent
+func WithLocation(dir string) TorrentOption {
+	return func(t *Torrent) {
+		t.Location = dir
+	}
+}
+
+// WithUploadSlots Cantidad de pares que atendemos a la vez en este torrent
+func WithUploadSlots(n int) TorrentOption {
+	return func(t *Torrent) {
+		t.UploadSlots = n
+	}
+}
+
 // ByStatus implements sort.Interface for []*Peer based on the PeerStatus field.
 type ByStatus []*Peer
 
 func (a ByStatus) Len() int      { return len(a) }
 func (a ByStatus) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 func (a ByStatus) Less(i, j int) bool {
-	if a[i].PeerStatus == a[j].PeerStatus {
+	if a[i].status() == a[j].status() {
 		return string(a[i].String()) < string(a[j].String())
 	}
-	return a[i].PeerStatus > a[j].PeerStatus
+	return a[i].status() > a[j].status()
 }
 
 // Init TODO
@@ -75,23 +118,34 @@ func (t *Torrent) Init() error {
 	t.peersAvailIn, t.peersAvailOut = makeInfinite()
 	// t.peersConnected = make(chan interface{}, 10000)
 
-	for _, tracker := range t.File.AnnounceList {
-		tr := &Tracker{
-			URL: tracker,
-		}
+	for _, tier := range t.File.AnnounceTiers {
+		var trackers []*Tracker
+		for _, tracker := range tier {
+			tr := &Tracker{
+				URL: tracker,
+			}
 
-		// Ignoro los errores
-		tr.SetTorrent(t)
-		tr.Init()
+			// Ignoro los errores
+			tr.SetTorrent(t)
+			tr.Init()
 
-		t.Trackers = append(t.Trackers, tr)
+			trackers = append(trackers, tr)
+			t.Trackers = append(t.Trackers, tr)
+		}
+		t.Tiers = append(t.Tiers, trackers)
 	}
 
 	t.Bitmap = make([]PieceMap, len(t.File.Info.Pieces))
+	t.downloading = make(map[int]*pieceBuffer)
+	t.picker = NewPiecePicker(t.Bitmap)
 	t.BitmapChan = make(chan int64)
 	t.Status = Stopped
 
-	return nil
+	if !t.File.HasInfo() {
+		// Viene de un magnet, el storage se abre cuando llega la metadata
+		return nil
+	}
+	return t.openStorage()
 }
 
 // SetSession TODO
@@ -99,8 +153,47 @@ func (t *Torrent) SetSession(session *Session) {
 	t.session = session
 }
 
+// openStorage Crea el storage donde se guardan las piezas del torrent
+func (t *Torrent) openStorage() error {
+	switch t.Backend {
+	case MemoryStorage:
+		t.storage = newMemoryStorage(t.File)
+	case MmapStorage:
+		s, err := newMmapStorage(t.Location, t.File)
+		if err != nil {
+			return err
+		}
+		t.storage = s
+	default:
+		t.storage = newFileStorage(t.Location, t.File)
+	}
+	return nil
+}
+
 // ResumeFromFile TODO
 func (t *Torrent) ResumeFromFile() error {
+	if t.File.HasInfo() {
+		if err := t.openStorage(); err != nil {
+			return err
+		}
+	}
+
+	// gob no mantiene los punteros compartidos entre Tiers y Trackers
+	if len(t.Tiers) > 0 {
+		t.Trackers = nil
+		for _, tier := range t.Tiers {
+			t.Trackers = append(t.Trackers, tier...)
+		}
+	}
+
+	// La disponibilidad guardada no sirve, los pares se vuelven a conectar
+	for i := range t.Bitmap {
+		t.Bitmap[i].Availability = 0
+		if t.Bitmap[i].Flag == FlagRequested {
+			t.Bitmap[i].Flag = FlagNone
+		}
+	}
+	t.picker = NewPiecePicker(t.Bitmap)
 	for _, tracker := range t.Trackers {
 		tracker.SetTorrent(t)
 		if err := tracker.ResumeFromFile(); err != nil {
@@ -113,7 +206,8 @@ func (t *Torrent) ResumeFromFile() error {
 			return err
 		}
 	}
-	if t.Status == Started {
+	// Los que estaban sembrando tambien siguen, para seguir subiendo y avisarle a los trackers al parar
+	if t.Status != Stopped {
 		t.Start()
 	}
 	return nil
@@ -121,11 +215,26 @@ func (t *Torrent) ResumeFromFile() error {
 
 // Start TODO
 func (t *Torrent) Start() {
+	t.mutexPieces.Lock()
 	t.Status = Started
+	if t.File.HasInfo() && t.Left <= 0 {
+		// Ya esta todo, arrancamos sembrando
+		t.Status = Completed
+	}
+	t.mutexPieces.Unlock()
 
-	// Me conecto a los trackers
-	for _, tr := range t.Trackers {
-		go tr.Start()
+	// Me conecto a los trackers, uno por tier
+	t.tierEvents = make([]chan TrackerEvent, len(t.Tiers))
+	for i := range t.Tiers {
+		t.tierEvents[i] = make(chan TrackerEvent, 1)
+		go t.announceTier(i)
+	}
+	// Sin esperar a la proxima vuelta de la DHT, los magnets sin trackers dependen de esto
+	if t.session != nil && t.session.dht != nil && !t.File.Info.Private {
+		go t.session.dht.GetPeers(t.File.InfoHash, int(t.session.port))
+	}
+	if t.session != nil {
+		t.session.lsdAnnounce(t)
 	}
 	// Inicializo el dispatcher de pares
 
@@ -143,6 +252,47 @@ func (t *Torrent) Start() {
 		close(t.peersAvailIn)
 	}()
 
+	go t.choker()
+	go t.pexLoop()
+	t.startWebSeeds()
+
+}
+
+// Stop Detiene el torrent y le avisa a los trackers
+func (t *Torrent) Stop() {
+	t.mutexPieces.Lock()
+	if t.Status == Stopped {
+		t.mutexPieces.Unlock()
+		return
+	}
+	t.Status = Stopped
+	t.mutexPieces.Unlock()
+
+	var wg sync.WaitGroup
+	for _, tr := range t.Trackers {
+		wg.Add(1)
+		go func(tr *Tracker) {
+			tr.Stop()
+			wg.Done()
+		}(tr)
+	}
+	wg.Wait()
+
+	// Despierto a los announcers para que vean que el torrent termino
+	t.tierEvent(EventNone)
+}
+
+// status Status leido con mutexPieces, que es con el que se escribe. Lo usan las GoRoutines del torrent.
+func (t *Torrent) status() StatusEnum {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+	return t.Status
+}
+
+// downloadCompleted Se llama una sola vez cuando se termina de descargar la ultima pieza
+func (t *Torrent) downloadCompleted() {
+	log.Printf("%s: download completed\n", t.File.Info.Name)
+	t.tierEvent(EventCompleted)
 }
 
 // Debug TODO
@@ -155,9 +305,12 @@ func (t *Torrent) Debug() {
 	log.Printf("    | Peers: %d\n", len(t.Peers))
 	sort.Sort(ByStatus(t.Peers))
 	for _, peer := range t.Peers {
-		log.Printf("      |  Peer: %21s %d %s\n", peer, peer.PeerStatus, peer.ErrorReason)
+		log.Printf("      |  Peer: %21s %d %s\n", peer, peer.status(), peer.ErrorReason)
 	}
 	log.Printf("    |  Perc: %f%%\n", float64(t.Downloaded)/float64(t.Left+t.Downloaded))
+	if t.Endgame {
+		log.Printf("    |  Endgame\n")
+	}
 }
 
 func (t *Torrent) startPeers(peers <-chan *Peer) {
@@ -182,11 +335,36 @@ func (t *Torrent) addPeer(p *Peer) {
 	t.peersAvailIn <- p
 }
 
+// addIncomingPeer Agrega un par que se conecto a nosotros. No se encola para conectarse porque ya esta conectado.
+// El puerto de origen cambia en cada conexion, por eso lo reconocemos por el peer id: si ya estamos conectados
+// lo rechazamos y si es un entrante viejo que se desconecto lo reemplazamos. Queda marcado como en uso.
+func (t *Torrent) addIncomingPeer(p *Peer) bool {
+	t.mutexPeers.Lock()
+	defer t.mutexPeers.Unlock()
+	for i := 0; i < len(t.Peers); i++ {
+		x := t.Peers[i]
+		if x.PeerID != p.PeerID && !(p.IP.Equal(x.IP) && p.Port == x.Port) {
+			continue
+		}
+		if x.using {
+			return false
+		}
+		if x.incoming {
+			t.Peers = append(t.Peers[:i], t.Peers[i+1:]...)
+			i--
+		}
+	}
+	p.SetTorrent(t)
+	p.using = true
+	t.Peers = append(t.Peers, p)
+	return true
+}
+
 func (t *Torrent) getAPeer() *Peer {
 	t.mutexPeers.RLock()
 	defer t.mutexPeers.RUnlock()
 	for _, x := range t.Peers {
-		if x.PeerStatus != PeerError && !x.using {
+		if x.status() != PeerError && !x.using {
 			return x
 		}
 	}
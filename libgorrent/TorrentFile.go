@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"time"
@@ -27,6 +28,9 @@ type TorrentFile struct {
 	// Es una extensión a la especificación original.
 	RawAnnounceList [][]string `bencode:"announce-list"`
 	AnnounceList    []string
+	// Los trackers agrupados por tier como en announce-list (BEP 12), mezclados dentro de cada tier.
+	// Si no hay announce-list es un solo tier con Announce.
+	AnnounceTiers [][]string
 	// (entero opcional) La fecha de creación del torrent en formato de época UNIX.
 	RawCreationDate int64 `bencode:"creation date"`
 	CreationDate    time.Time
@@ -34,9 +38,17 @@ type TorrentFile struct {
 	Comment string
 	// (cadena opcional) Nombre y versión del programa usado para crear el archivo torrent.
 	CreatedBy string `bencode:"created-by"`
+	// Web seeds de url-list (BEP 19). En el archivo puede ser una URL sola o una lista.
+	// Solo se usan las HTTP y HTTPS, las demas (ftp://) se ignoran.
+	URLList []string
+	// Seeds HTTP con script (BEP 17), sirven piezas por info_hash, piece y ranges.
+	// Tambien solo HTTP y HTTPS.
+	HTTPSeeds []string `bencode:"httpseeds"`
 
 	InfoHash []byte
-	Info     struct {
+	// El diccionario info tal cual vino, es lo que se le manda a los pares con ut_metadata (BEP 9)
+	InfoBytes []byte
+	Info      struct {
 		// (cadena) El nombre del archivo o directorio donde se almacenarán los archivos.
 		Name string
 		// Como dijimos en la introducción, el archivo que queremos compartir es dividido en piezas.
@@ -71,6 +83,40 @@ func appendIfMissing(slice []string, i string) []string {
 	return append(slice, i)
 }
 
+// buildAnnounceTiers Arma AnnounceTiers y AnnounceList a partir de announce y announce-list
+func (t *TorrentFile) buildAnnounceTiers() {
+	t.AnnounceTiers = nil
+	t.AnnounceList = nil
+
+	if len(t.RawAnnounceList) == 0 {
+		if t.Announce != "" {
+			t.AnnounceTiers = [][]string{{t.Announce}}
+			t.AnnounceList = []string{t.Announce}
+		}
+		return
+	}
+
+	for _, raw := range t.RawAnnounceList {
+		var tier []string
+		for _, url := range raw {
+			if url == "" {
+				continue
+			}
+			tier = appendIfMissing(tier, url)
+			t.AnnounceList = appendIfMissing(t.AnnounceList, url)
+		}
+		if len(tier) == 0 {
+			continue
+		}
+
+		// BEP 12: los trackers de cada tier se mezclan una sola vez al cargar
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		t.AnnounceTiers = append(t.AnnounceTiers, tier)
+	}
+}
+
 // GetLength TODO
 func (t *TorrentFile) GetLength() int64 {
 	if len(t.Info.Files) == 0 {
@@ -114,24 +160,10 @@ func LoadFromFile(fname string) (*TorrentFile, error) {
 		return nil, err
 	}
 
-	// Process the pieces
-	plen := len(torrent.Info.AllPieces) / sha1.Size
-	torrent.Info.Pieces = make([][]byte, plen)
-	for i := 0; i < plen; i++ {
-		torrent.Info.Pieces[i] = []byte(torrent.Info.AllPieces[i*20 : (i+1)*20])
-	}
-
-	// Process the paths
-	for i := range torrent.Info.Files {
-		pathParts := append([]string{torrent.Info.Name}, torrent.Info.Files[i].RawPath...)
-		torrent.Info.Files[i].Path = filepath.Join(pathParts...)
-	}
+	torrent.processInfo()
 
 	// Process the announcelist
-	torrent.AnnounceList = appendIfMissing(torrent.AnnounceList, torrent.Announce)
-	for i := range torrent.RawAnnounceList {
-		torrent.AnnounceList = appendIfMissing(torrent.AnnounceList, torrent.RawAnnounceList[i][0])
-	}
+	torrent.buildAnnounceTiers()
 
 	torrent.CreationDate = time.Unix(torrent.RawCreationDate, 0)
 
@@ -159,10 +191,61 @@ func LoadFromFile(fname string) (*TorrentFile, error) {
 	hash := sha1.New()
 	hash.Write(infoBuffer.Bytes())
 	torrent.InfoHash = hash.Sum(nil)
+	torrent.InfoBytes = infoBuffer.Bytes()
+
+	torrent.URLList = parseURLList(torrentDict["url-list"])
 
 	return &torrent, nil
 }
 
+// processInfo Separa los hashes de las piezas y arma los paths de los archivos
+func (t *TorrentFile) processInfo() {
+	// Process the pieces
+	plen := len(t.Info.AllPieces) / sha1.Size
+	t.Info.Pieces = make([][]byte, plen)
+	for i := 0; i < plen; i++ {
+		t.Info.Pieces[i] = []byte(t.Info.AllPieces[i*20 : (i+1)*20])
+	}
+
+	// Process the paths
+	for i := range t.Info.Files {
+		pathParts := append([]string{t.Info.Name}, t.Info.Files[i].RawPath...)
+		t.Info.Files[i].Path = filepath.Join(pathParts...)
+	}
+}
+
+// HasInfo Indica si ya tenemos el diccionario info. Un torrent agregado desde un magnet no lo tiene hasta bajarlo de los pares.
+func (t *TorrentFile) HasInfo() bool {
+	return len(t.Info.Pieces) > 0
+}
+
+// SetInfo Carga el diccionario info bajado de los pares. Verifica que coincida con el info hash.
+func (t *TorrentFile) SetInfo(info []byte) error {
+	hash := sha1.Sum(info)
+	if !bytes.Equal(hash[:], t.InfoHash) {
+		return errors.New("Metadata does not match the info hash")
+	}
+
+	file := TorrentFile{}
+	if err := bencode.Unmarshal(bytes.NewReader(info), &file.Info); err != nil {
+		return errors.New("Failed to decode metadata: " + err.Error())
+	}
+	file.processInfo()
+
+	if !file.HasInfo() || file.Info.PieceLength <= 0 {
+		return errors.New("Metadata has no pieces")
+	}
+	for _, f := range file.GetFiles() {
+		if f.Length < 0 {
+			return errors.New("Metadata has a file with negative length")
+		}
+	}
+
+	t.Info = file.Info
+	t.InfoBytes = info
+	return nil
+}
+
 // Debug TODO
 func (t *TorrentFile) Debug() {
 	fmt.Printf("Name: %s\n", t.Info.Name)
@@ -177,8 +260,24 @@ func (t *TorrentFile) Debug() {
 	fmt.Printf("Announce: %s\n", t.Announce)
 	fmt.Printf("AnnounceList:\n")
 
-	for i := range t.AnnounceList {
-		fmt.Printf("\t%+v\n", t.AnnounceList[i])
+	for i := range t.AnnounceTiers {
+		fmt.Printf("\tTier %d:\n", i)
+		for j := range t.AnnounceTiers[i] {
+			fmt.Printf("\t\t%+v\n", t.AnnounceTiers[i][j])
+		}
+	}
+
+	if len(t.URLList) > 0 {
+		fmt.Printf("URLList:\n")
+		for _, u := range t.URLList {
+			fmt.Printf("\t%s\n", u)
+		}
+	}
+	if len(t.HTTPSeeds) > 0 {
+		fmt.Printf("HTTPSeeds:\n")
+		for _, u := range t.HTTPSeeds {
+			fmt.Printf("\t%s\n", u)
+		}
 	}
 
 	fmt.Printf("Comment: %s\n", t.Comment)
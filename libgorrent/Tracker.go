@@ -3,11 +3,13 @@ package libgorrent
 import (
 	"encoding/binary"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	bencode "github.com/jackpal/bencode-go"
@@ -32,23 +34,120 @@ const (
 	Error
 )
 
+// TrackerEvent Evento que se le manda al tracker en el announce
+type TrackerEvent int
+
+// TODO
+const (
+	EventNone TrackerEvent = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// String Nombre del evento como lo espera un tracker HTTP
+func (e TrackerEvent) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+const (
+	// trackerRetryInterval Cuanto esperar para reintentar despues de un error
+	trackerRetryInterval = 60 * time.Second
+
+	// trackerHTTPTimeout TODO
+	trackerHTTPTimeout = 30 * time.Second
+)
+
 // Tracker TODO
 type Tracker struct {
 	Protocol  Protocol
 	URL       string
 	LastError string
 	Status    TrackerStatus
+	// Seeders y leechers segun el ultimo announce
+	Seeders  int64
+	Leechers int64
 
 	// Privates
-	torrent   *Torrent
-	trackerID []byte
-	interval  int64
+	torrent     *Torrent
+	trackerID   []byte
+	interval    int64
+	minInterval int64
+
+	// UDP. El scrape corre en paralelo con los announces, el connection id va con udpMutex.
+	udpMutex         sync.Mutex
+	connectionID     uint64
+	connectionIDTime time.Time
+	key              uint32
 }
 
 // HTTPTrackerResponse TODO
 type HTTPTrackerResponse struct {
-	Interval int64  `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int64  `bencode:"interval"`
+	MinInterval    int64  `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Complete       int64  `bencode:"complete"`
+	Incomplete     int64  `bencode:"incomplete"`
+	// Compacto (string) o una lista de diccionarios con peer id, ip y port
+	Peers interface{} `bencode:"peers"`
+	// Compacto IPv6 (BEP 7)
+	Peers6 string `bencode:"peers6"`
+}
+
+// decodeHTTPTrackerResponse Decodifica la respuesta a mano porque peers puede venir en dos formatos
+func decodeHTTPTrackerResponse(r io.Reader) (*HTTPTrackerResponse, error) {
+	dict, err := decodeDict(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTPTrackerResponse{
+		FailureReason:  dictString(dict, "failure reason"),
+		WarningMessage: dictString(dict, "warning message"),
+		Interval:       dictInt(dict, "interval"),
+		MinInterval:    dictInt(dict, "min interval"),
+		TrackerID:      dictString(dict, "tracker id"),
+		Complete:       dictInt(dict, "complete"),
+		Incomplete:     dictInt(dict, "incomplete"),
+		Peers:          dict["peers"],
+		Peers6:         dictString(dict, "peers6"),
+	}, nil
+}
+
+// decodeDict Decodifica un diccionario bencode sin tipar
+func decodeDict(r io.Reader) (map[string]interface{}, error) {
+	data, err := bencode.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Response is not a dictionary")
+	}
+	return dict, nil
+}
+
+// dictString TODO
+func dictString(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
+
+// dictInt TODO
+func dictInt(dict map[string]interface{}, key string) int64 {
+	i, _ := dict[key].(int64)
+	return i
 }
 
 // SetTorrent Funcion que setea el torrent en el tracker. Esta funcion existe para no crear una recursividad en gob
@@ -76,39 +175,61 @@ func (tr *Tracker) Init() error {
 
 // ResumeFromFile TODO
 func (tr *Tracker) ResumeFromFile() error {
+	tr.Status = NotConnected
 	return nil
 }
 
-// Start GoRoutine TODO
-func (tr *Tracker) Start() {
-	for {
-		if tr.Status == NotConnected {
-			switch tr.Protocol {
-			case HTTP:
-				if err := tr.connectHTTP(); err != nil {
-					log.Println(err.Error())
-					tr.LastError = err.Error()
-					tr.Status = Error
-				}
-
-			case UDP:
-			default:
-				log.Println("Protocol not supported " + tr.URL)
-				tr.LastError = "Protocol not supported " + tr.URL
-				tr.Status = Error
-				return
-			}
-		}
+// Stop Avisa al tracker que dejamos el swarm. Solo tiene sentido si alguna vez le anunciamos algo.
+func (tr *Tracker) Stop() {
+	if tr.Status != Connected {
+		return
+	}
 
-		if tr.interval <= 0 {
-			tr.interval = 10
-		}
+	if err := tr.announce(EventStopped, 0); err != nil {
+		log.Println(err.Error())
+	}
+	tr.Status = NotConnected
+}
 
-		time.Sleep(time.Duration(tr.interval) * time.Second)
+// supported TODO
+func (tr *Tracker) supported() bool {
+	return strings.HasPrefix(tr.URL, "http") || strings.HasPrefix(tr.URL, "udp")
+}
+
+// nextAnnounce Cuanto esperar hasta el proximo announce respetando el min interval del tracker
+func (tr *Tracker) nextAnnounce() time.Duration {
+	if tr.Status == Error {
+		return trackerRetryInterval
 	}
+
+	if tr.interval <= 0 {
+		tr.interval = 10
+	}
+	interval := tr.interval
+	if interval < tr.minInterval {
+		interval = tr.minInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// announce TODO
+func (tr *Tracker) announce(event TrackerEvent, retries int) error {
+	if !tr.supported() {
+		tr.Status = Error
+		tr.LastError = "Protocol not supported " + tr.URL
+		return errors.New(tr.LastError)
+	}
+
+	switch tr.Protocol {
+	case HTTP:
+		return tr.announceHTTP(event)
+	case UDP:
+		return tr.announceUDP(event, retries)
+	}
+	return errors.New("Protocol not supported " + tr.URL)
 }
 
-func (tr *Tracker) connectHTTP() error {
+func (tr *Tracker) announceHTTP(event TrackerEvent) error {
 	req, err := http.NewRequest("GET", tr.URL, nil)
 	if err != nil {
 		return errors.New("Could not create request to " + tr.URL + ": " + err.Error())
@@ -122,12 +243,24 @@ func (tr *Tracker) connectHTTP() error {
 	q.Add("downloaded", strconv.FormatInt(tr.torrent.Downloaded, 10))
 	q.Add("left", strconv.FormatInt(tr.torrent.Left, 10))
 	q.Add("compact", "1")
+	if event != EventNone {
+		q.Add("event", event.String())
+	}
+	if event == EventStopped {
+		q.Add("numwant", "0")
+	}
+	if ip := tr.torrent.session.AnnounceIP; ip != "" {
+		q.Add("ip", ip)
+	}
+	if ipv6 := tr.torrent.session.announceIPv6(); ipv6 != nil {
+		q.Add("ipv6", ipv6.String())
+	}
 	if tr.trackerID != nil {
 		q.Add("trackerid", string(tr.trackerID))
 	}
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: trackerHTTPTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
 		return errors.New("Errored when sending request to the server: " + err.Error())
@@ -136,18 +269,53 @@ func (tr *Tracker) connectHTTP() error {
 	defer resp.Body.Close()
 
 	// Parseo la respuesta
-	res := &HTTPTrackerResponse{}
-	err = bencode.Unmarshal(resp.Body, res)
+	res, err := decodeHTTPTrackerResponse(resp.Body)
 	if err != nil {
 		return errors.New("Cannot decode tracker response. " + err.Error())
 	}
 
-	for i := 0; i < len(res.Peers)/6; i++ {
-		alldata := res.Peers[i*6 : (i+1)*6]
+	if res.FailureReason != "" {
+		return errors.New("Tracker " + tr.URL + " failed: " + res.FailureReason)
+	}
+
+	if res.WarningMessage != "" {
+		log.Println("Tracker " + tr.URL + " warning: " + res.WarningMessage)
+		tr.LastError = "Warning: " + res.WarningMessage
+	} else {
+		tr.LastError = ""
+	}
+
+	if res.TrackerID != "" {
+		tr.trackerID = []byte(res.TrackerID)
+	}
+
+	tr.Seeders = res.Complete
+	tr.Leechers = res.Incomplete
+
+	if event != EventStopped {
+		switch peers := res.Peers.(type) {
+		case string:
+			tr.addCompactPeers([]byte(peers))
+		case []interface{}:
+			tr.addDictPeers(peers)
+		}
+		tr.addCompactPeers6([]byte(res.Peers6))
+	}
+
+	tr.interval = res.Interval
+	tr.minInterval = res.MinInterval
+	tr.Status = Connected
+	return nil
+}
+
+// addCompactPeers Agrega los pares en formato compacto (4 bytes de IP y 2 de puerto)
+func (tr *Tracker) addCompactPeers(data []byte) {
+	for i := 0; i < len(data)/6; i++ {
+		alldata := data[i*6 : (i+1)*6]
 
 		p := &Peer{
 			IP:         net.IPv4(alldata[0], alldata[1], alldata[2], alldata[3]),
-			Port:       binary.BigEndian.Uint16([]byte(alldata[4:])),
+			Port:       binary.BigEndian.Uint16(alldata[4:]),
 			Choked:     true,
 			Interested: false,
 		}
@@ -159,8 +327,52 @@ func (tr *Tracker) connectHTTP() error {
 		p.Init()
 		tr.torrent.addPeer(p)
 	}
+}
 
-	tr.interval = res.Interval
-	tr.Status = Connected
-	return nil
+// addCompactPeers6 Agrega los pares en formato compacto IPv6 (16 bytes de IP y 2 de puerto)
+func (tr *Tracker) addCompactPeers6(data []byte) {
+	for i := 0; i < len(data)/18; i++ {
+		alldata := data[i*18 : (i+1)*18]
+
+		p := &Peer{
+			IP:         net.IP(append([]byte(nil), alldata[:16]...)),
+			Port:       binary.BigEndian.Uint16(alldata[16:]),
+			Choked:     true,
+			Interested: false,
+		}
+
+		if p.Port <= 0 {
+			continue
+		}
+
+		p.Init()
+		tr.torrent.addPeer(p)
+	}
+}
+
+// addDictPeers Agrega los pares en el formato original, una lista de diccionarios con peer id, ip y port
+func (tr *Tracker) addDictPeers(list []interface{}) {
+	for _, x := range list {
+		dict, ok := x.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		ip := net.ParseIP(dictString(dict, "ip"))
+		port := dictInt(dict, "port")
+		if ip == nil || port <= 0 || port > 65535 {
+			continue
+		}
+
+		p := &Peer{
+			IP:         ip,
+			Port:       uint16(port),
+			Choked:     true,
+			Interested: false,
+		}
+		copy(p.PeerID[:], dictString(dict, "peer id"))
+
+		p.Init()
+		tr.torrent.addPeer(p)
+	}
 }
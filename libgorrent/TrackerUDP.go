@@ -0,0 +1,257 @@
+package libgorrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Constantes del protocolo de trackers UDP (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDTTL Un connection id se puede usar durante un minuto
+	udpConnectionIDTTL = time.Minute
+
+	// udpMaxRetries Despues de esto damos al tracker por muerto (15 * 2 ^ 8 segundos)
+	udpMaxRetries = 8
+
+	// udpTierRetries Reintentos de cada tracker en un tier con varios (15 + 30 segundos). Con los 8 de siempre
+	// un tracker caido nos tendria mas de dos horas sin probar el siguiente.
+	udpTierRetries = 1
+
+	// udpScrapeRetries Un scrape es solo informativo, no vale la pena esperar tanto como en un announce
+	udpScrapeRetries = 1
+
+	// udpMaxScrape Cantidad maxima de info hashes en un scrape
+	udpMaxScrape = 74
+)
+
+// udpTimeout Timeout base de las retransmisiones, se duplica en cada intento. Es variable para poder achicarlo en tests.
+var udpTimeout = 15 * time.Second
+
+// ScrapeResult Estado del swarm de un torrent segun el tracker
+type ScrapeResult struct {
+	// Seeders
+	Complete int64
+	// Cantidad de veces que se completo la descarga
+	Downloaded int64
+	// Leechers
+	Incomplete int64
+}
+
+// dialUDP Abre el socket hacia el tracker
+func (tr *Tracker) dialUDP() (net.Conn, error) {
+	u, err := url.Parse(tr.URL)
+	if err != nil {
+		return nil, errors.New("Invalid tracker URL " + tr.URL + ": " + err.Error())
+	}
+
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, errors.New("Could not reach tracker " + tr.URL + ": " + err.Error())
+	}
+	return conn, nil
+}
+
+// udpRoundTrip Manda el pedido y espera la respuesta con el mismo transaction id,
+// retransmitiendo con el timeout 15 * 2 ^ n hasta retries veces. Devuelve la respuesta sin action ni transaction id.
+func udpRoundTrip(conn net.Conn, req []byte, action uint32, retries int) ([]byte, error) {
+	txID := binary.BigEndian.Uint32(req[12:16])
+	buf := make([]byte, 2048)
+
+	for n := 0; n <= retries; n++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(udpTimeout * time.Duration(1<<uint(n)))
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			l, err := conn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if l < 8 || binary.BigEndian.Uint32(buf[4:8]) != txID {
+				// No es para nosotros
+				continue
+			}
+
+			switch binary.BigEndian.Uint32(buf[0:4]) {
+			case action:
+				return append([]byte(nil), buf[8:l]...), nil
+			case udpActionError:
+				return nil, errors.New("Tracker error: " + string(buf[8:l]))
+			default:
+				return nil, errors.New("Unexpected action in tracker response")
+			}
+		}
+	}
+
+	return nil, errors.New("Tracker did not answer")
+}
+
+// udpConnect Obtiene un connection id. Si el que tenemos todavia sirve lo reutiliza.
+func (tr *Tracker) udpConnect(conn net.Conn, retries int) (uint64, error) {
+	tr.udpMutex.Lock()
+	connID, since := tr.connectionID, time.Since(tr.connectionIDTime)
+	tr.udpMutex.Unlock()
+	if connID != 0 && since < udpConnectionIDTTL {
+		return connID, nil
+	}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], rand.Uint32())
+
+	res, err := udpRoundTrip(conn, req, udpActionConnect, retries)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) < 8 {
+		return 0, errors.New("Connect response too short")
+	}
+
+	connID = binary.BigEndian.Uint64(res[0:8])
+	tr.udpMutex.Lock()
+	tr.connectionID = connID
+	tr.connectionIDTime = time.Now()
+	tr.udpMutex.Unlock()
+	return connID, nil
+}
+
+// forgetConnectionID El tracker no contesto, puede ser que el connection id haya expirado de su lado
+func (tr *Tracker) forgetConnectionID() {
+	tr.udpMutex.Lock()
+	tr.connectionID = 0
+	tr.udpMutex.Unlock()
+}
+
+// announceUDP Announce contra un tracker UDP, retransmitiendo hasta retries veces
+func (tr *Tracker) announceUDP(event TrackerEvent, retries int) error {
+	conn, err := tr.dialUDP()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Si estamos cerrando no tiene sentido esperar minutos al tracker, ni para el connect
+	if event == EventStopped {
+		retries = 0
+	}
+
+	connID, err := tr.udpConnect(conn, retries)
+	if err != nil {
+		return errors.New("Could not connect to " + tr.URL + ": " + err.Error())
+	}
+
+	if tr.key == 0 {
+		tr.key = rand.Uint32()
+	}
+
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(req[12:16], rand.Uint32())
+	copy(req[16:36], tr.torrent.File.InfoHash)
+	copy(req[36:56], tr.torrent.session.peerID)
+	binary.BigEndian.PutUint64(req[56:64], uint64(tr.torrent.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(tr.torrent.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(tr.torrent.Uploaded))
+	// Los valores de TrackerEvent coinciden con los de BEP 15
+	binary.BigEndian.PutUint32(req[80:84], uint32(event))
+	// ip (0 = el de origen)
+	binary.BigEndian.PutUint32(req[88:92], tr.key)
+	if event == EventStopped {
+		binary.BigEndian.PutUint32(req[92:96], 0)
+	} else {
+		binary.BigEndian.PutUint32(req[92:96], 0xFFFFFFFF) // num_want -1
+	}
+	binary.BigEndian.PutUint16(req[96:98], uint16(tr.torrent.session.port))
+
+	res, err := udpRoundTrip(conn, req, udpActionAnnounce, retries)
+	if err != nil {
+		tr.forgetConnectionID()
+		return errors.New("Announce to " + tr.URL + " failed: " + err.Error())
+	}
+	if len(res) < 12 {
+		return errors.New("Announce response from " + tr.URL + " too short")
+	}
+
+	tr.interval = int64(binary.BigEndian.Uint32(res[0:4]))
+	tr.Leechers = int64(binary.BigEndian.Uint32(res[4:8]))
+	tr.Seeders = int64(binary.BigEndian.Uint32(res[8:12]))
+	if event != EventStopped {
+		// Si hablamos con el tracker por IPv6 los pares vienen en formato IPv6
+		if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+			tr.addCompactPeers6(res[12:])
+		} else {
+			tr.addCompactPeers(res[12:])
+		}
+	}
+
+	tr.LastError = ""
+	tr.Status = Connected
+	return nil
+}
+
+// scrapeUDP Scrape de varios info hashes en un solo pedido
+func (tr *Tracker) scrapeUDP(hashes [][]byte) ([]ScrapeResult, error) {
+	if len(hashes) > udpMaxScrape {
+		return nil, errors.New("Too many info hashes for a single UDP scrape")
+	}
+
+	conn, err := tr.dialUDP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	connID, err := tr.udpConnect(conn, udpScrapeRetries)
+	if err != nil {
+		return nil, errors.New("Could not connect to " + tr.URL + ": " + err.Error())
+	}
+
+	req := make([]byte, 16+20*len(hashes))
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+	binary.BigEndian.PutUint32(req[12:16], rand.Uint32())
+	for i, h := range hashes {
+		copy(req[16+20*i:16+20*(i+1)], h)
+	}
+
+	res, err := udpRoundTrip(conn, req, udpActionScrape, udpScrapeRetries)
+	if err != nil {
+		tr.forgetConnectionID()
+		return nil, errors.New("Scrape of " + tr.URL + " failed: " + err.Error())
+	}
+	if len(res) < 12*len(hashes) {
+		return nil, errors.New("Scrape response from " + tr.URL + " too short")
+	}
+
+	ret := make([]ScrapeResult, len(hashes))
+	for i := range ret {
+		data := res[12*i : 12*(i+1)]
+		ret[i] = ScrapeResult{
+			Complete:   int64(binary.BigEndian.Uint32(data[0:4])),
+			Downloaded: int64(binary.BigEndian.Uint32(data[4:8])),
+			Incomplete: int64(binary.BigEndian.Uint32(data[8:12])),
+		}
+	}
+	return ret, nil
+}
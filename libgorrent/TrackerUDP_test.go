@@ -0,0 +1,229 @@
+package libgorrent
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpTrackerStub Tracker UDP minimo para los tests. Si badTxID contesta primero con
+// otro transaction id, y si silent no contesta nada.
+type udpTrackerStub struct {
+	conn    *net.UDPConn
+	badTxID bool
+	silent  bool
+
+	connects  int32
+	announces int32
+}
+
+func newUDPTrackerStub(t *testing.T, badTxID, silent bool) *udpTrackerStub {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &udpTrackerStub{conn: conn, badTxID: badTxID, silent: silent}
+	go st.serve(t)
+	return st
+}
+
+func (st *udpTrackerStub) URL() string {
+	return "udp://" + st.conn.LocalAddr().String() + "/announce"
+}
+
+func (st *udpTrackerStub) Close() {
+	st.conn.Close()
+}
+
+func (st *udpTrackerStub) serve(t *testing.T) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := st.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 || st.silent {
+			continue
+		}
+
+		action := binary.BigEndian.Uint32(buf[8:12])
+		var res []byte
+		switch action {
+		case udpActionConnect:
+			atomic.AddInt32(&st.connects, 1)
+			if binary.BigEndian.Uint64(buf[0:8]) != udpProtocolID {
+				t.Error("connect without the protocol id")
+			}
+			res = make([]byte, 16)
+			binary.BigEndian.PutUint64(res[8:16], 0xC0FFEE)
+		case udpActionAnnounce:
+			atomic.AddInt32(&st.announces, 1)
+			if n != 98 || binary.BigEndian.Uint64(buf[0:8]) != 0xC0FFEE {
+				t.Errorf("bad announce of %d bytes", n)
+			}
+			res = make([]byte, 20, 26)
+			binary.BigEndian.PutUint32(res[8:12], 1800)
+			binary.BigEndian.PutUint32(res[12:16], 3)
+			binary.BigEndian.PutUint32(res[16:20], 7)
+			res = append(res, 127, 0, 0, 1, 0x1a, 0xe1)
+		case udpActionScrape:
+			hashes := (n - 16) / 20
+			res = make([]byte, 8+12*hashes)
+			for i := 0; i < hashes; i++ {
+				binary.BigEndian.PutUint32(res[8+12*i:], uint32(10+i))
+				binary.BigEndian.PutUint32(res[16+12*i:], uint32(20+i))
+			}
+		default:
+			continue
+		}
+		binary.BigEndian.PutUint32(res[0:4], action)
+		copy(res[4:8], buf[12:16])
+
+		if st.badTxID {
+			// Una respuesta que no es para este pedido, el cliente la tiene que ignorar
+			bad := append([]byte(nil), res...)
+			bad[7]++
+			if action == udpActionAnnounce {
+				binary.BigEndian.PutUint32(bad[12:16], 99)
+			}
+			st.conn.WriteToUDP(bad, addr)
+		}
+		st.conn.WriteToUDP(res, addr)
+	}
+}
+
+// testUDPTracker Un tracker con su torrent apuntando al stub
+func testUDPTracker(t *testing.T, st *udpTrackerStub) *Tracker {
+	tf, _ := testTorrentFile(t, 100000, 32768)
+	tor, err := testSession(6881).AddTorrent(tf, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &Tracker{URL: st.URL()}
+	tr.SetTorrent(tor)
+	if err := tr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func shortUDPTimeout() func() {
+	old := udpTimeout
+	udpTimeout = 100 * time.Millisecond
+	return func() { udpTimeout = old }
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	defer shortUDPTimeout()()
+	st := newUDPTrackerStub(t, false, false)
+	defer st.Close()
+	tr := testUDPTracker(t, st)
+
+	if err := tr.announceUDP(EventStarted, udpMaxRetries); err != nil {
+		t.Fatal(err)
+	}
+	if tr.interval != 1800 || tr.Leechers != 3 || tr.Seeders != 7 {
+		t.Fatalf("interval %d, leechers %d, seeders %d", tr.interval, tr.Leechers, tr.Seeders)
+	}
+	if len(tr.torrent.Peers) != 1 || tr.torrent.Peers[0].Port != 6881 {
+		t.Fatalf("peers %v", tr.torrent.Peers)
+	}
+
+	// El connection id todavia sirve, no hace falta otro connect
+	if err := tr.announceUDP(EventNone, udpMaxRetries); err != nil {
+		t.Fatal(err)
+	}
+	connects, announces := atomic.LoadInt32(&st.connects), atomic.LoadInt32(&st.announces)
+	if connects != 1 || announces != 2 {
+		t.Fatalf("%d connects, %d announces", connects, announces)
+	}
+}
+
+func TestUDPTrackerTxIDMismatch(t *testing.T) {
+	defer shortUDPTimeout()()
+	st := newUDPTrackerStub(t, true, false)
+	defer st.Close()
+	tr := testUDPTracker(t, st)
+
+	if err := tr.announceUDP(EventStarted, udpMaxRetries); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Seeders != 7 {
+		t.Fatalf("took the answer with the wrong transaction id, seeders %d", tr.Seeders)
+	}
+
+	res, err := tr.scrapeUDP([][]byte{tr.torrent.File.InfoHash, make([]byte, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Complete != 10 || res[1].Complete != 11 || res[1].Incomplete != 21 {
+		t.Fatalf("scrape %v", res)
+	}
+}
+
+func TestUDPTrackerStoppedDoesNotRetry(t *testing.T) {
+	defer shortUDPTimeout()()
+	st := newUDPTrackerStub(t, false, true)
+	defer st.Close()
+	tr := testUDPTracker(t, st)
+
+	start := time.Now()
+	err := tr.announceUDP(EventStopped, udpMaxRetries)
+	if err == nil || !strings.Contains(err.Error(), "did not answer") {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("stopped announce took %s", time.Since(start))
+	}
+}
+
+func TestUDPTrackerTierSkipsDeadTracker(t *testing.T) {
+	defer shortUDPTimeout()()
+	dead := newUDPTrackerStub(t, false, true)
+	defer dead.Close()
+	live := newUDPTrackerStub(t, false, false)
+	defer live.Close()
+
+	tr := testUDPTracker(t, live)
+	tor := tr.torrent
+	first := &Tracker{URL: dead.URL()}
+	first.SetTorrent(tor)
+	first.Init()
+	tor.Tiers = [][]*Tracker{{first, tr}}
+
+	// Con todos los reintentos el tracker muerto tardaria 51 segundos
+	start := time.Now()
+	got, err := tor.tierAnnounce(0, EventStarted)
+	if err != nil || got != tr {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("tier announce took %s", elapsed)
+	}
+	if tor.Tiers[0][0] != tr {
+		t.Fatal("the tracker that answered was not moved to the front")
+	}
+}
+
+func TestUDPTrackerScrapeDuringAnnounce(t *testing.T) {
+	defer shortUDPTimeout()()
+	st := newUDPTrackerStub(t, false, false)
+	defer st.Close()
+	tr := testUDPTracker(t, st)
+
+	// El scrape de la sesion corre junto con los announces de los tiers, con -race no puede saltar nada
+	done := make(chan error, 1)
+	go func() {
+		_, err := tr.Scrape()
+		done <- err
+	}()
+	if err := tr.announceUDP(EventStarted, udpMaxRetries); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,199 @@
+package libgorrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpMaxPacket Ningun paquete de DHT o uTP es mas grande que esto
+const udpMaxPacket = 64 * 1024
+
+// udpMux Socket UDP del puerto de la sesion compartido entre la DHT y uTP.
+// Los mensajes de la DHT son diccionarios bencodeados y empiezan con 'd',
+// los de uTP empiezan con el tipo y la version 1.
+type udpMux struct {
+	conn net.PacketConn
+	done chan struct{}
+
+	mutex  sync.Mutex
+	conns  map[utpKey]*utpConn
+	accept chan *utpConn
+	dht    *muxPacketConn
+}
+
+// utpKey Las conexiones uTP se identifican por la direccion del par y el connection id con el que recibimos
+type utpKey struct {
+	addr string
+	id   uint16
+}
+
+// udpSocket Devuelve el socket UDP de la sesion, abriendolo la primera vez
+func (s *Session) udpSocket() (*udpMux, error) {
+	s.udpMutex.Lock()
+	defer s.udpMutex.Unlock()
+
+	if s.udp != nil {
+		return s.udp, nil
+	}
+	m, err := newUDPMux(fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return nil, err
+	}
+	s.udp = m
+	return m, nil
+}
+
+// newUDPMux Abre el socket en addr y empieza a repartir los paquetes
+func newUDPMux(addr string) (*udpMux, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, errors.New("Could not listen on UDP " + addr + ": " + err.Error())
+	}
+	return newUDPMuxConn(conn), nil
+}
+
+// newUDPMuxConn Reparte los paquetes de un socket ya abierto
+func newUDPMuxConn(conn net.PacketConn) *udpMux {
+	m := &udpMux{
+		conn:  conn,
+		done:  make(chan struct{}),
+		conns: make(map[utpKey]*utpConn),
+	}
+	go m.readLoop()
+	return m
+}
+
+// readLoop GoRoutine que lee el socket y le pasa cada paquete a quien corresponda
+func (m *udpMux) readLoop() {
+	buf := make([]byte, udpMaxPacket)
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Println("UDP socket closed: " + err.Error())
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+
+		switch {
+		case data[0] == 'd':
+			m.mutex.Lock()
+			dht := m.dht
+			m.mutex.Unlock()
+			if dht != nil {
+				dht.deliver(data, addr)
+			}
+		case isUTP(data):
+			m.utpPacket(data, addr)
+		}
+	}
+}
+
+// packetConn Un PacketConn para la DHT que solo recibe los paquetes bencodeados
+func (m *udpMux) packetConn() net.PacketConn {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.dht == nil {
+		m.dht = &muxPacketConn{
+			mux:  m,
+			in:   make(chan muxPacket, 256),
+			done: make(chan struct{}),
+		}
+	}
+	return m.dht
+}
+
+// Close Cierra el socket y todas las conexiones uTP
+func (m *udpMux) Close() error {
+	select {
+	case <-m.done:
+		return nil
+	default:
+	}
+	close(m.done)
+
+	m.mutex.Lock()
+	var conns []*utpConn
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mutex.Unlock()
+	for _, c := range conns {
+		c.fail(net.ErrClosed)
+	}
+
+	return m.conn.Close()
+}
+
+// muxPacket Un paquete de la DHT esperando a que lo lean
+type muxPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// muxPacketConn La parte DHT del socket compartido. Cerrarla no cierra el socket.
+type muxPacketConn struct {
+	mux  *udpMux
+	in   chan muxPacket
+	done chan struct{}
+	once sync.Once
+}
+
+// deliver Encola un paquete, si la DHT no da abasto lo tiramos como haria el kernel
+func (c *muxPacketConn) deliver(data []byte, addr net.Addr) {
+	select {
+	case c.in <- muxPacket{data, addr}:
+	default:
+	}
+}
+
+func (c *muxPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.data), p.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-c.mux.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *muxPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.mux.conn.WriteTo(b, addr)
+}
+
+func (c *muxPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *muxPacketConn) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+// La DHT no usa deadlines de lectura
+func (c *muxPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *muxPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *muxPacketConn) SetWriteDeadline(t time.Time) error { return nil }
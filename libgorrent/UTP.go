@@ -0,0 +1,933 @@
+package libgorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tipos de paquete de uTP (BEP 29)
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+const (
+	// utpVersion Version del protocolo, va en los 4 bits bajos del primer byte
+	utpVersion = 1
+
+	// utpHeaderSize Tamaño del header sin extensiones
+	utpHeaderSize = 20
+
+	// utpExtSACK Extension de selective ACK
+	utpExtSACK = 1
+
+	// utpPayloadSize Datos por paquete, chico para no fragmentar con cualquier MTU razonable
+	utpPayloadSize = 1200
+
+	// utpMinWindow La ventana de congestion nunca baja de esto
+	utpMinWindow = 2 * utpPayloadSize
+
+	// utpMaxWindow Ni sube de esto
+	utpMaxWindow = 1 << 20
+
+	// utpRecvWindow Lo que aceptamos tener recibido sin que lo lean
+	utpRecvWindow = 1 << 20
+
+	// utpSendBuffer Lo que aceptamos tener escrito sin mandar
+	utpSendBuffer = 256 * 1024
+
+	// utpTargetDelay Retardo de cola objetivo de LEDBAT, en microsegundos
+	utpTargetDelay = 100000
+
+	// utpMaxCwndIncrease Lo maximo que crece la ventana por RTT, en bytes
+	utpMaxCwndIncrease = 3000
+
+	// utpBaseDelayWindow El retardo base es el minimo de este periodo
+	utpBaseDelayWindow = 2 * time.Minute
+
+	// utpInitialTimeout Timeout de retransmision hasta tener una medicion del RTT
+	utpInitialTimeout = time.Second
+
+	// utpMinTimeout El timeout de retransmision nunca baja de esto
+	utpMinTimeout = 500 * time.Millisecond
+
+	// utpMaxTimeout Ni sube de esto
+	utpMaxTimeout = 30 * time.Second
+
+	// utpMaxRetransmits Despues de tantas veces sin ACK damos la conexion por muerta
+	utpMaxRetransmits = 6
+
+	// utpMaxOutOfOrder Paquetes fuera de orden que guardamos como maximo
+	utpMaxOutOfOrder = 1024
+
+	// utpConnectTimeout Si el par no contesta el SYN en este tiempo damos por fallado el intento por uTP
+	utpConnectTimeout = 3 * time.Second
+
+	// utpHeadStart Ventaja que le damos a uTP antes de probar tambien por TCP. Un par que solo
+	// habla TCP no nos hace esperar todo utpConnectTimeout.
+	utpHeadStart = 500 * time.Millisecond
+
+	// utpLinger Tiempo que le damos a lo que quedaba por mandar despues de Close
+	utpLinger = 10 * time.Second
+
+	// utpTickInterval Cada cuanto revisamos timeouts y mandamos lo pendiente
+	utpTickInterval = 50 * time.Millisecond
+)
+
+// utpHeader Header de un paquete uTP ya parseado
+type utpHeader struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32
+	tsDiff    uint32
+	wnd       uint32
+	seq       uint16
+	ack       uint16
+	sack      []byte
+}
+
+// utpPacket Un paquete mandado que todavia no tiene ACK
+type utpPacket struct {
+	typ           byte
+	seq           uint16
+	data          []byte
+	sent          time.Time
+	transmissions int
+	fastResent    bool
+}
+
+// utpConn Una conexion uTP. Implementa net.Conn sobre el socket UDP de la sesion.
+type utpConn struct {
+	mux    *udpMux
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+	done   chan struct{}
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	connected bool
+	// Close ya se llamo, no se puede leer ni escribir
+	closed bool
+	// La conexion termino, es lo que devuelven Read y Write
+	err error
+
+	// Proximo numero de secuencia a mandar y ultimo recibido en orden
+	seqNr uint16
+	ackNr uint16
+
+	sendBuf    []byte
+	inflight   []*utpPacket
+	curWindow  int
+	maxWindow  float64
+	peerWindow int
+	rtt        time.Duration
+	rttVar     time.Duration
+	timeout    time.Duration
+	lastAck    uint16
+	dupAcks    int
+
+	// LEDBAT
+	baseDelay     uint32
+	baseDelayTime time.Time
+	replyMicro    uint32
+
+	recvBuf    bytes.Buffer
+	outOfOrder map[uint16][]byte
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+	advertised int
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+// isUTP El paquete parece uTP: version 1 y un tipo conocido
+func isUTP(data []byte) bool {
+	return len(data) >= utpHeaderSize && data[0]&0x0f == utpVersion && data[0]>>4 <= utpSyn
+}
+
+// parseUTP Parsea el header y las extensiones, devuelve el payload
+func parseUTP(data []byte) (*utpHeader, []byte, error) {
+	if !isUTP(data) {
+		return nil, nil, errors.New("Not a uTP packet")
+	}
+
+	h := &utpHeader{
+		typ:       data[0] >> 4,
+		connID:    binary.BigEndian.Uint16(data[2:4]),
+		timestamp: binary.BigEndian.Uint32(data[4:8]),
+		tsDiff:    binary.BigEndian.Uint32(data[8:12]),
+		wnd:       binary.BigEndian.Uint32(data[12:16]),
+		seq:       binary.BigEndian.Uint16(data[16:18]),
+		ack:       binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	ext := data[1]
+	off := utpHeaderSize
+	for ext != 0 {
+		if off+2 > len(data) {
+			return nil, nil, errors.New("Truncated uTP extension")
+		}
+		next, length := data[off], int(data[off+1])
+		if off+2+length > len(data) {
+			return nil, nil, errors.New("Truncated uTP extension")
+		}
+		if ext == utpExtSACK {
+			h.sack = data[off+2 : off+2+length]
+		}
+		ext = next
+		off += 2 + length
+	}
+
+	return h, data[off:], nil
+}
+
+// encode Arma el paquete con el header, el selective ACK si hay y los datos
+func (h *utpHeader) encode(payload []byte) []byte {
+	buf := make([]byte, utpHeaderSize, utpHeaderSize+2+len(h.sack)+len(payload))
+	buf[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	if len(h.sack) > 0 {
+		buf[1] = utpExtSACK
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+// utpMicros Reloj en microsegundos para los timestamps, solo importan las diferencias
+func utpMicros() uint32 {
+	return uint32(time.Now().UnixNano() / 1000)
+}
+
+// seqBefore a va antes que b teniendo en cuenta que los numeros de secuencia dan la vuelta
+func seqBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func newUTPConn(m *udpMux, raddr *net.UDPAddr, recvID, sendID uint16) *utpConn {
+	c := &utpConn{
+		mux:        m,
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		done:       make(chan struct{}),
+		maxWindow:  utpMinWindow,
+		peerWindow: utpRecvWindow,
+		timeout:    utpInitialTimeout,
+		outOfOrder: make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// dialUTP Abre una conexion uTP con addr desde el socket UDP de la sesion
+func (s *Session) dialUTP(addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.udpSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%21s Dial uTP\n", addr)
+	c, err := m.dialUTP(raddr, utpConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialUTP Manda el SYN y espera el STATE del otro lado
+func (m *udpMux) dialUTP(raddr *net.UDPAddr, timeout time.Duration) (*utpConn, error) {
+	m.mutex.Lock()
+	var id uint16
+	for {
+		id = binary.BigEndian.Uint16(generateRandomBytes(2))
+		if _, ok := m.conns[utpKey{raddr.String(), id}]; !ok {
+			break
+		}
+	}
+	c := newUTPConn(m, raddr, id, id+1)
+	m.conns[utpKey{raddr.String(), id}] = c
+	m.mutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.seqNr = 1
+	syn := &utpPacket{typ: utpSyn, seq: c.seqNr}
+	c.seqNr++
+	c.inflight = append(c.inflight, syn)
+	c.transmit(syn)
+	go c.tickLoop()
+
+	timer := time.AfterFunc(timeout, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if !c.connected {
+			c.failLocked(errors.New("timed out"))
+		}
+	})
+	defer timer.Stop()
+
+	for !c.connected && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return nil, errors.New("uTP connection failed: " + c.err.Error())
+	}
+	return c, nil
+}
+
+// utpPacket Reparte un paquete uTP a su conexion. Un SYN nuevo es una conexion entrante.
+func (m *udpMux) utpPacket(data []byte, addr *net.UDPAddr) {
+	h, payload, err := parseUTP(data)
+	if err != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	c := m.utpLookup(addr, h)
+	if c == nil && h.typ == utpSyn && m.accept != nil {
+		// Quien inicia recibe con connID y manda con connID+1
+		c = newUTPConn(m, addr, h.connID+1, h.connID)
+		c.connected = true
+		c.ackNr = h.seq
+		c.seqNr = binary.BigEndian.Uint16(generateRandomBytes(2))
+
+		key := utpKey{addr.String(), c.recvID}
+		m.conns[key] = c
+		select {
+		case m.accept <- c:
+		default:
+			// Nadie esta aceptando
+			delete(m.conns, key)
+			m.mutex.Unlock()
+			return
+		}
+		m.mutex.Unlock()
+
+		go c.tickLoop()
+		c.receive(h, nil)
+		return
+	}
+	m.mutex.Unlock()
+
+	if c != nil {
+		c.receive(h, payload)
+	} else if h.typ != utpReset {
+		// No conocemos la conexion, le avisamos que la cierre
+		reset := &utpHeader{typ: utpReset, connID: h.connID, timestamp: utpMicros(), seq: h.ack, ack: h.seq}
+		m.conn.WriteTo(reset.encode(nil), addr)
+	}
+}
+
+// utpLookup Busca la conexion del paquete. Se llama con mutex tomado.
+func (m *udpMux) utpLookup(addr *net.UDPAddr, h *utpHeader) *utpConn {
+	id := h.connID
+	if h.typ == utpSyn {
+		id++
+	}
+	if c, ok := m.conns[utpKey{addr.String(), id}]; ok {
+		return c
+	}
+	if h.typ == utpReset {
+		// Algunos mandan el RESET con su connection id, no con el nuestro
+		for _, other := range []uint16{id - 1, id + 1} {
+			if c, ok := m.conns[utpKey{addr.String(), other}]; ok && c.sendID == id {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// remove Saca la conexion del socket
+func (m *udpMux) remove(c *utpConn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := utpKey{c.raddr.String(), c.recvID}
+	if m.conns[key] == c {
+		delete(m.conns, key)
+	}
+}
+
+// receive Procesa un paquete de la conexion
+func (c *utpConn) receive(h *utpHeader, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.replyMicro = utpMicros() - h.timestamp
+	c.peerWindow = int(h.wnd)
+
+	switch h.typ {
+	case utpReset:
+		c.failLocked(errors.New("uTP connection reset by peer"))
+		return
+	case utpSyn:
+		// Es el SYN de una conexion entrante o se perdio nuestro STATE
+		c.sendState()
+		return
+	}
+
+	if !c.connected {
+		if h.typ != utpState {
+			return
+		}
+		// El primer DATA del otro lado viene con el mismo seq que este STATE
+		c.connected = true
+		c.ackNr = h.seq - 1
+	}
+
+	c.ackReceived(h)
+
+	switch h.typ {
+	case utpData:
+		c.dataReceived(h.seq, payload)
+		c.sendState()
+	case utpFin:
+		if !c.gotFin {
+			c.gotFin = true
+			c.finSeq = h.seq
+			c.advance()
+		}
+		c.sendState()
+	}
+
+	c.flush()
+	c.cond.Broadcast()
+}
+
+// ackReceived Saca de los paquetes en vuelo los que confirma el par y ajusta la ventana
+func (c *utpConn) ackReceived(h *utpHeader) {
+	now := time.Now()
+	acked := 0
+
+	for len(c.inflight) > 0 && !seqBefore(h.ack, c.inflight[0].seq) {
+		acked += c.ackPacket(c.inflight[0], now)
+		c.inflight = c.inflight[1:]
+	}
+
+	// Selective ACK: el bit i es el paquete ack+2+i
+	var sacked []uint16
+	for i := 0; i < len(h.sack)*8; i++ {
+		if h.sack[i/8]&(1<<uint(i%8)) != 0 {
+			sacked = append(sacked, h.ack+2+uint16(i))
+		}
+	}
+	if len(sacked) > 0 {
+		var kept []*utpPacket
+		for _, p := range c.inflight {
+			i := int(p.seq - h.ack - 2)
+			if i < len(h.sack)*8 && h.sack[i/8]&(1<<uint(i%8)) != 0 {
+				acked += c.ackPacket(p, now)
+				continue
+			}
+			kept = append(kept, p)
+		}
+		c.inflight = kept
+	}
+
+	if h.ack == c.lastAck && acked == 0 && h.typ == utpState && len(c.inflight) > 0 {
+		c.dupAcks++
+	} else if h.ack != c.lastAck {
+		c.lastAck = h.ack
+		c.dupAcks = 0
+	}
+
+	if acked > 0 && h.tsDiff != 0 {
+		c.ledbat(acked, h.tsDiff)
+	}
+	if acked > 0 && c.rtt > 0 {
+		// El par responde, se termina el backoff de los timeouts
+		c.timeout = c.rtt + 4*c.rttVar
+		if c.timeout < utpMinTimeout {
+			c.timeout = utpMinTimeout
+		}
+	}
+
+	// Fast retransmit: un paquete se perdio si llegaron 3 despues de el
+	lost := false
+	for i, p := range c.inflight {
+		after := 0
+		for _, seq := range sacked {
+			if seqBefore(p.seq, seq) {
+				after++
+			}
+		}
+		if i == 0 && p.seq == h.ack+1 && c.dupAcks >= 3 {
+			after = c.dupAcks
+		}
+		if after >= 3 && !p.fastResent {
+			p.fastResent = true
+			c.transmit(p)
+			lost = true
+		}
+	}
+	if lost {
+		c.maxWindow /= 2
+		if c.maxWindow < utpMinWindow {
+			c.maxWindow = utpMinWindow
+		}
+	}
+}
+
+// ackPacket Un paquete llego al otro lado. Si se mando una sola vez sirve para medir el RTT.
+func (c *utpConn) ackPacket(p *utpPacket, now time.Time) int {
+	c.curWindow -= len(p.data)
+
+	if p.transmissions == 1 {
+		sample := now.Sub(p.sent)
+		if c.rtt == 0 {
+			c.rtt = sample
+			c.rttVar = sample / 2
+		} else {
+			delta := c.rtt - sample
+			if delta < 0 {
+				delta = -delta
+			}
+			c.rttVar += (delta - c.rttVar) / 4
+			c.rtt += (sample - c.rtt) / 8
+		}
+	}
+
+	return len(p.data)
+}
+
+// ledbat Ajusta la ventana segun cuanto se aleja el retardo de ida del objetivo
+func (c *utpConn) ledbat(acked int, delay uint32) {
+	if c.baseDelayTime.IsZero() || time.Since(c.baseDelayTime) > utpBaseDelayWindow {
+		c.baseDelay = delay
+		c.baseDelayTime = time.Now()
+	} else if int32(delay-c.baseDelay) < 0 {
+		c.baseDelay = delay
+	}
+
+	ourDelay := float64(int32(delay - c.baseDelay))
+	offTarget := (utpTargetDelay - ourDelay) / utpTargetDelay
+	c.maxWindow += utpMaxCwndIncrease * offTarget * float64(acked) / c.maxWindow
+
+	if c.maxWindow < utpMinWindow {
+		c.maxWindow = utpMinWindow
+	}
+	if c.maxWindow > utpMaxWindow {
+		c.maxWindow = utpMaxWindow
+	}
+}
+
+// dataReceived Guarda los datos de un paquete, en orden o para despues
+func (c *utpConn) dataReceived(seq uint16, data []byte) {
+	diff := seq - (c.ackNr + 1)
+	if diff >= utpMaxOutOfOrder || c.gotFin && !seqBefore(seq, c.finSeq) {
+		// Repetido o fuera de la ventana
+		return
+	}
+
+	if diff == 0 {
+		c.recvBuf.Write(data)
+		c.ackNr = seq
+		c.advance()
+	} else if _, ok := c.outOfOrder[seq]; !ok {
+		c.outOfOrder[seq] = append([]byte(nil), data...)
+	}
+}
+
+// advance Pasa al buffer de lectura los paquetes que quedaron en orden
+func (c *utpConn) advance() {
+	for {
+		next := c.ackNr + 1
+		if c.gotFin && next == c.finSeq {
+			c.ackNr = next
+			c.eof = true
+			return
+		}
+		data, ok := c.outOfOrder[next]
+		if !ok {
+			return
+		}
+		delete(c.outOfOrder, next)
+		c.recvBuf.Write(data)
+		c.ackNr = next
+	}
+}
+
+// sackMask Selective ACK de los paquetes fuera de orden, en multiplos de 4 bytes
+func (c *utpConn) sackMask() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+	last := 0
+	for seq := range c.outOfOrder {
+		if i := int(seq - c.ackNr - 2); i > last && i < utpMaxOutOfOrder {
+			last = i
+		}
+	}
+	mask := make([]byte, (last/32+1)*4)
+	for i := 0; i < len(mask)*8; i++ {
+		if _, ok := c.outOfOrder[c.ackNr+2+uint16(i)]; ok {
+			mask[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return mask
+}
+
+// window Lo que nos queda de buffer de recepcion
+func (c *utpConn) window() int {
+	if n := utpRecvWindow - c.recvBuf.Len(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// send Completa el header con el estado de la conexion y lo manda
+func (c *utpConn) send(h *utpHeader, payload []byte) {
+	h.timestamp = utpMicros()
+	h.tsDiff = c.replyMicro
+	h.wnd = uint32(c.window())
+	h.ack = c.ackNr
+	h.sack = c.sackMask()
+	c.advertised = int(h.wnd)
+
+	c.mux.conn.WriteTo(h.encode(payload), c.raddr)
+}
+
+// sendState Manda un ACK
+func (c *utpConn) sendState() {
+	c.send(&utpHeader{typ: utpState, connID: c.sendID, seq: c.seqNr}, nil)
+}
+
+// transmit Manda o vuelve a mandar un paquete en vuelo
+func (c *utpConn) transmit(p *utpPacket) {
+	p.sent = time.Now()
+	p.transmissions++
+
+	h := &utpHeader{typ: p.typ, connID: c.sendID, seq: p.seq}
+	if p.typ == utpSyn {
+		h.connID = c.recvID
+	}
+	c.send(h, p.data)
+}
+
+// flush Manda lo escrito mientras entre en la ventana. Si no hay nada en vuelo manda uno igual.
+func (c *utpConn) flush() {
+	sent := false
+	for len(c.sendBuf) > 0 && c.connected && c.err == nil {
+		n := len(c.sendBuf)
+		if n > utpPayloadSize {
+			n = utpPayloadSize
+		}
+		window := int(c.maxWindow)
+		if c.peerWindow < window {
+			window = c.peerWindow
+		}
+		if c.curWindow > 0 && c.curWindow+n > window || len(c.inflight) >= utpMaxOutOfOrder {
+			break
+		}
+
+		p := &utpPacket{typ: utpData, seq: c.seqNr, data: append([]byte(nil), c.sendBuf[:n]...)}
+		c.seqNr++
+		c.sendBuf = c.sendBuf[n:]
+		c.curWindow += n
+		c.inflight = append(c.inflight, p)
+		c.transmit(p)
+		sent = true
+	}
+	if sent {
+		c.cond.Broadcast()
+	}
+}
+
+// tickLoop GoRoutine que retransmite por timeout y manda lo que quedo pendiente
+func (c *utpConn) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		c.checkTimeout()
+		c.flush()
+		c.mutex.Unlock()
+	}
+}
+
+// checkTimeout Si el paquete mas viejo no tiene ACK a tiempo lo repetimos y achicamos la ventana
+func (c *utpConn) checkTimeout() {
+	if len(c.inflight) == 0 || c.err != nil {
+		return
+	}
+	p := c.inflight[0]
+	if time.Since(p.sent) < c.timeout {
+		return
+	}
+	if p.transmissions >= utpMaxRetransmits {
+		c.failLocked(errors.New("uTP connection timed out"))
+		return
+	}
+
+	c.maxWindow = utpMinWindow
+	c.timeout *= 2
+	if c.timeout > utpMaxTimeout {
+		c.timeout = utpMaxTimeout
+	}
+	c.transmit(p)
+}
+
+// fail Termina la conexion con err
+func (c *utpConn) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.failLocked(err)
+}
+
+// failLocked Termina la conexion con err. Se llama con mutex tomado.
+func (c *utpConn) failLocked(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+	}
+	if c.writeTimer != nil {
+		c.writeTimer.Stop()
+	}
+	c.mux.remove(c)
+	c.cond.Broadcast()
+}
+
+// expired El deadline t ya paso
+func expired(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.recvBuf.Len() == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	n, _ := c.recvBuf.Read(b)
+	if c.err == nil && c.advertised < utpRecvWindow/2 && c.window() >= utpRecvWindow/2 {
+		// Le avisamos al par que se libero la ventana
+		c.sendState()
+	}
+	return n, nil
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		for len(c.sendBuf) >= utpSendBuffer && !c.closed && c.err == nil && !expired(c.writeDeadline) {
+			c.cond.Wait()
+		}
+		switch {
+		case c.closed:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		case expired(c.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := len(b) - written
+		if free := utpSendBuffer - len(c.sendBuf); n > free {
+			n = free
+		}
+		c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+		written += n
+		c.flush()
+	}
+	return written, nil
+}
+
+// Close Manda lo que quedaba y despues el FIN sin bloquear al que cierra
+func (c *utpConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cond.Broadcast()
+
+	if c.err == nil {
+		if c.connected {
+			go c.linger()
+		} else {
+			c.failLocked(net.ErrClosed)
+		}
+	}
+	return nil
+}
+
+// linger GoRoutine que espera los ACK de lo pendiente y del FIN antes de soltar la conexion
+func (c *utpConn) linger() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deadline := time.Now().Add(utpLinger)
+	timer := time.AfterFunc(utpLinger, func() {
+		c.mutex.Lock()
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	fin := false
+	for c.err == nil && time.Now().Before(deadline) {
+		if len(c.sendBuf) == 0 && len(c.inflight) == 0 {
+			if fin {
+				break
+			}
+			// El FIN se retransmite como cualquier paquete hasta que tenga ACK
+			p := &utpPacket{typ: utpFin, seq: c.seqNr}
+			c.seqNr++
+			c.inflight = append(c.inflight, p)
+			c.transmit(p)
+			fin = true
+		}
+		c.cond.Wait()
+	}
+	c.failLocked(net.ErrClosed)
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readDeadline = t
+	c.readTimer = c.deadlineTimer(c.readTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeDeadline = t
+	c.writeTimer = c.deadlineTimer(c.writeTimer, t)
+	c.cond.Broadcast()
+	return nil
+}
+
+// deadlineTimer Despierta a los que esperan cuando vence el deadline
+func (c *utpConn) deadlineTimer(old *time.Timer, t time.Time) *time.Timer {
+	if old != nil {
+		old.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mutex.Lock()
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+	})
+}
+
+// utpListener Conexiones uTP entrantes en el socket de la sesion
+type utpListener struct {
+	mux    *udpMux
+	accept chan *utpConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// listen Empieza a aceptar conexiones uTP
+func (m *udpMux) listen() net.Listener {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.accept = make(chan *utpConn, 32)
+	return &utpListener{mux: m, accept: m.accept, done: make(chan struct{})}
+}
+
+func (l *utpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.mux.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *utpListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.mux.mutex.Lock()
+		if l.mux.accept == l.accept {
+			l.mux.accept = nil
+		}
+		l.mux.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *utpListener) Addr() net.Addr {
+	return l.mux.conn.LocalAddr()
+}
@@ -0,0 +1,323 @@
+package libgorrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// badConn Un socket que pierde y desordena una parte de los paquetes que manda
+type badConn struct {
+	net.PacketConn
+	loss    int
+	reorder int
+
+	mutex     sync.Mutex
+	rnd       *mrand.Rand
+	held      []byte
+	heldAddr  net.Addr
+	dropped   int
+	reordered int
+}
+
+func (c *badConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.rnd.Intn(100) < c.loss {
+		c.dropped++
+		return len(b), nil
+	}
+	if c.held == nil && c.rnd.Intn(100) < c.reorder {
+		// Sale despues del proximo
+		c.held = append([]byte(nil), b...)
+		c.heldAddr = addr
+		c.reordered++
+		return len(b), nil
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if c.held != nil {
+		c.PacketConn.WriteTo(c.held, c.heldAddr)
+		c.held = nil
+	}
+	return n, err
+}
+
+func (c *badConn) stats() (dropped, reordered int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.dropped, c.reordered
+}
+
+// testUDPMux Un socket en loopback. Si loss o reorder no son 0 pierde y desordena ese porcentaje de paquetes.
+func testUDPMux(t *testing.T, loss, reorder int) (*udpMux, *badConn) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loss == 0 && reorder == 0 {
+		return newUDPMuxConn(conn), nil
+	}
+	bad := &badConn{PacketConn: conn, loss: loss, reorder: reorder, rnd: mrand.New(mrand.NewSource(1))}
+	return newUDPMuxConn(bad), bad
+}
+
+// utpPair Una conexion uTP de a hacia b
+func utpPair(t *testing.T, a, b *udpMux) (*utpConn, *utpConn) {
+	l := b.listen()
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := a.dialUTP(b.conn.LocalAddr().(*net.UDPAddr), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case other := <-accepted:
+		return c, other.(*utpConn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not accepted")
+	}
+	return nil, nil
+}
+
+// utpTransfer Manda size bytes de c1 a c2 y otros tantos de vuelta al mismo tiempo
+func utpTransfer(t *testing.T, c1, c2 *utpConn, size int) {
+	there, back := make([]byte, size), make([]byte, size)
+	rand.Read(there)
+	rand.Read(back)
+
+	var wg sync.WaitGroup
+	check := func(w, r *utpConn, data []byte) {
+		defer wg.Done()
+		go w.Write(data)
+		r.SetReadDeadline(time.Now().Add(30 * time.Second))
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("data does not match")
+		}
+	}
+	wg.Add(2)
+	go check(c1, c2, there)
+	go check(c2, c1, back)
+	wg.Wait()
+}
+
+func TestUTPTransfer(t *testing.T) {
+	a, _ := testUDPMux(t, 0, 0)
+	defer a.Close()
+	b, _ := testUDPMux(t, 0, 0)
+	defer b.Close()
+
+	c1, c2 := utpPair(t, a, b)
+	utpTransfer(t, c1, c2, 2<<20)
+
+	// Sin perdidas y con poco retardo LEDBAT abre la ventana
+	c1.mutex.Lock()
+	window := c1.maxWindow
+	c1.mutex.Unlock()
+	if window <= utpMinWindow {
+		t.Fatalf("window did not grow: %f", window)
+	}
+	c1.Close()
+	c2.Close()
+}
+
+func TestUTPLossyReordering(t *testing.T) {
+	a, badA := testUDPMux(t, 3, 10)
+	defer a.Close()
+	b, badB := testUDPMux(t, 3, 10)
+	defer b.Close()
+
+	c1, c2 := utpPair(t, a, b)
+	utpTransfer(t, c1, c2, 512<<10)
+
+	// Llego todo igual, asi que lo perdido se retransmitio y lo desordenado se acomodo
+	for _, bad := range []*badConn{badA, badB} {
+		if dropped, reordered := bad.stats(); dropped == 0 || reordered == 0 {
+			t.Fatalf("%d packets dropped and %d reordered, the test did not exercise anything", dropped, reordered)
+		}
+	}
+	c1.Close()
+	c2.Close()
+}
+
+func TestUTPSelectiveAck(t *testing.T) {
+	m, _ := testUDPMux(t, 0, 0)
+	defer m.Close()
+	c := newUTPConn(m, m.conn.LocalAddr().(*net.UDPAddr), 1, 2)
+	c.connected = true
+
+	// Del otro lado llegaron el 12 y el 15 pero no el 11
+	c.ackNr = 10
+	c.outOfOrder[12] = []byte("x")
+	c.outOfOrder[15] = []byte("x")
+	if mask := c.sackMask(); !bytes.Equal(mask, []byte{0x09, 0, 0, 0}) {
+		t.Fatalf("sack mask %x", mask)
+	}
+
+	// Mandamos del 20 al 25, el par confirma hasta el 20 y por SACK el 22, 23 y 24
+	for seq := uint16(20); seq <= 25; seq++ {
+		p := &utpPacket{typ: utpData, seq: seq, data: make([]byte, 100), sent: time.Now(), transmissions: 1}
+		c.inflight = append(c.inflight, p)
+		c.curWindow += 100
+	}
+	c.mutex.Lock()
+	c.ackReceived(&utpHeader{typ: utpState, ack: 20, sack: []byte{0x07, 0, 0, 0}})
+	c.mutex.Unlock()
+
+	if len(c.inflight) != 2 || c.inflight[0].seq != 21 || c.inflight[1].seq != 25 {
+		t.Fatalf("%d packets in flight", len(c.inflight))
+	}
+	if c.curWindow != 200 {
+		t.Fatalf("%d bytes in flight", c.curWindow)
+	}
+	// El 21 tiene tres confirmados despues, se da por perdido y se repite sin esperar el timeout
+	if p := c.inflight[0]; !p.fastResent || p.transmissions != 2 {
+		t.Fatal("the packet before the sack was not retransmitted")
+	}
+	if c.inflight[1].fastResent {
+		t.Fatal("retransmitted a packet that was not lost")
+	}
+	if c.maxWindow != utpMinWindow {
+		t.Fatalf("window %f after a loss", c.maxWindow)
+	}
+}
+
+func TestUTPTeardown(t *testing.T) {
+	a, _ := testUDPMux(t, 0, 0)
+	defer a.Close()
+	b, _ := testUDPMux(t, 0, 0)
+	defer b.Close()
+
+	c1, c2 := utpPair(t, a, b)
+	c1.Write([]byte("bye"))
+	c1.Close()
+
+	// Lo escrito antes del Close llega y despues el FIN se lee como EOF
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(c2)
+	if err != nil || string(got) != "bye" {
+		t.Fatal(string(got), err)
+	}
+	if _, err := c1.Write([]byte("x")); err != net.ErrClosed {
+		t.Fatal(err)
+	}
+	c2.Close()
+
+	// Con los FIN confirmados las dos conexiones se sueltan del socket
+	empty := func(m *udpMux) func() bool {
+		return func() bool {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			return len(m.conns) == 0
+		}
+	}
+	if !waitFor(5*time.Second, empty(a)) || !waitFor(5*time.Second, empty(b)) {
+		t.Fatal("connections were not released after closing")
+	}
+}
+
+func TestUTPReset(t *testing.T) {
+	a, _ := testUDPMux(t, 0, 0)
+	defer a.Close()
+	b, _ := testUDPMux(t, 0, 0)
+
+	c1, _ := utpPair(t, a, b)
+	// Se cae el otro lado, el proximo paquete recibe un RESET
+	b.Close()
+	b2 := newUDPMuxConn(reopenUDP(t, b.conn.LocalAddr().String()))
+	defer b2.Close()
+
+	c1.Write([]byte("hello"))
+	c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c1.Read(make([]byte, 10)); err == nil || err == os.ErrDeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+// reopenUDP Vuelve a abrir el socket en la misma direccion
+func reopenUDP(t *testing.T, addr string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestUTPDeadline(t *testing.T) {
+	a, _ := testUDPMux(t, 0, 0)
+	defer a.Close()
+	b, _ := testUDPMux(t, 0, 0)
+	defer b.Close()
+
+	c1, c2 := utpPair(t, a, b)
+	c1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c1.Read(make([]byte, 10)); err != os.ErrDeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	// Sin deadline se sigue leyendo normalmente
+	c2.Write([]byte("hi"))
+	c1.SetReadDeadline(time.Time{})
+	buf := make([]byte, 10)
+	if n, err := c1.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatal(n, err)
+	}
+}
+
+func TestUTPDialTimeout(t *testing.T) {
+	a, _ := testUDPMux(t, 0, 0)
+	defer a.Close()
+
+	// Un socket que no contesta nada
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	start := time.Now()
+	if _, err := a.dialUTP(silent.LocalAddr().(*net.UDPAddr), 300*time.Millisecond); err == nil {
+		t.Fatal("dial to a silent address succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial took %s", elapsed)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.conns) != 0 {
+		t.Fatal("the failed connection was not released")
+	}
+}
+
+func TestDialTCPOnlyPeer(t *testing.T) {
+	// El que siembra no escucha por uTP, el SYN nunca tiene respuesta
+	seed, tor, data := seedSession(t, 22520, func(s *Session) { s.DisableUTP = true })
+	defer seed.Close()
+
+	start := time.Now()
+	leech, m := leechFrom(t, 22521, tor, nil)
+	defer leech.Close()
+
+	if !waitFor(utpConnectTimeout, func() bool { return downloaded(m, data) }) {
+		t.Fatalf("download did not finish before the uTP timeout, %s", time.Since(start))
+	}
+	if encrypted, plain, utp := encryptedPeers(m); utp > 0 || encrypted+plain == 0 {
+		t.Fatalf("%d of %d peers over uTP", utp, encrypted+plain)
+	}
+}
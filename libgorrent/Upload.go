@@ -0,0 +1,229 @@
+package libgorrent
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	// maxRequestLength Un par que pide mas que esto no sigue las reglas y lo desconectamos
+	maxRequestLength = 1 << 15
+
+	// maxUploadQueue Pedidos pendientes que le aceptamos a cada par
+	maxUploadQueue = 250
+)
+
+// ourBitfield Arma el bitfield con las piezas que ya tenemos
+func (t *Torrent) ourBitfield() Bitfield {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	b := NewBitfield(len(t.Bitmap))
+	for i := range t.Bitmap {
+		if t.Bitmap[i].Flag == FlagCompleted {
+			b.Set(i)
+		}
+	}
+	return b
+}
+
+// hasPiece TODO
+func (t *Torrent) hasPiece(index int) bool {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	return index >= 0 && index < len(t.Bitmap) && t.Bitmap[index].Flag == FlagCompleted
+}
+
+// broadcastHave Le avisa a todos los pares conectados que tenemos una pieza nueva
+func (t *Torrent) broadcastHave(index int) {
+	t.mutexPeers.RLock()
+	defer t.mutexPeers.RUnlock()
+
+	for _, p := range t.Peers {
+		if p.status() == PeerConnected {
+			p.Send(&Message{ID: MsgHave, Index: uint32(index)})
+		}
+	}
+}
+
+// addUploaded Suma los bytes subidos al torrent
+func (t *Torrent) addUploaded(n int) {
+	t.mutexPieces.Lock()
+	t.Uploaded += int64(n)
+	t.mutexPieces.Unlock()
+}
+
+// sendBitfield Se manda justo despues del handshake, solo si tenemos alguna pieza.
+// Con la Fast Extension siempre se manda algo y si tenemos todas o ninguna alcanza con Have All o Have None.
+func (p *Peer) sendBitfield() error {
+	b := p.torrent.ourBitfield()
+	count := b.Count()
+
+	if p.supportsFast() {
+		switch {
+		case count == 0:
+			return p.Send(&Message{ID: MsgHaveNone})
+		case count == len(p.torrent.File.Info.Pieces):
+			return p.Send(&Message{ID: MsgHaveAll})
+		}
+	}
+
+	if count == 0 {
+		return nil
+	}
+	return p.Send(&Message{ID: MsgBitfield, Bitfield: b})
+}
+
+// choke Dejamos de atender los pedidos del par y descartamos los que tenia.
+// Con la Fast Extension seguimos con los de piezas allowed fast y rechazamos el resto explicitamente.
+func (p *Peer) choke() error {
+	p.umu.Lock()
+	if p.AmChoking {
+		p.umu.Unlock()
+		return nil
+	}
+	p.AmChoking = true
+	var rejected []blockRequest
+	if p.supportsFast() {
+		var keep []blockRequest
+		for _, req := range p.uploads {
+			if p.fastSet.Has(int(req.Index)) {
+				keep = append(keep, req)
+			} else {
+				rejected = append(rejected, req)
+			}
+		}
+		p.uploads = keep
+	} else {
+		p.uploads = nil
+	}
+	p.umu.Unlock()
+
+	if err := p.Send(&Message{ID: MsgChoke}); err != nil {
+		return err
+	}
+	for _, req := range rejected {
+		if err := p.reject(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchoke Empezamos a atender los pedidos del par
+func (p *Peer) unchoke() error {
+	p.umu.Lock()
+	if !p.AmChoking {
+		p.umu.Unlock()
+		return nil
+	}
+	p.AmChoking = false
+	p.umu.Unlock()
+
+	return p.Send(&Message{ID: MsgUnchoke})
+}
+
+// handleRequest Encola un pedido del par. Los pedidos se atienden en uploader.
+func (p *Peer) handleRequest(m *Message) error {
+	req := blockRequest{Index: m.Index, Begin: m.Begin, Length: m.Length}
+
+	if req.Length == 0 || req.Length > maxRequestLength {
+		return fmt.Errorf("Invalid request length %d", req.Length)
+	}
+	if !p.torrent.hasPiece(int(req.Index)) ||
+		int64(req.Begin)+int64(req.Length) > p.torrent.File.GetPieceLength(int(req.Index)) {
+		log.Printf("%21s- Request for a piece we don't have %d:%d+%d\n", p, req.Index, req.Begin, req.Length)
+		return p.reject(req)
+	}
+
+	p.umu.Lock()
+	allowed := !p.AmChoking || p.fastSet.Has(int(req.Index))
+	if !allowed || len(p.uploads) >= maxUploadQueue {
+		p.umu.Unlock()
+		return p.reject(req)
+	}
+	for _, x := range p.uploads {
+		if x == req {
+			p.umu.Unlock()
+			return nil
+		}
+	}
+	p.uploads = append(p.uploads, req)
+	p.umu.Unlock()
+
+	select {
+	case p.uploadSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// handleCancel Saca el pedido de la cola si todavia no lo mandamos.
+// Con la Fast Extension hay que contestar el Cancel con un Reject.
+func (p *Peer) handleCancel(m *Message) error {
+	req := blockRequest{Index: m.Index, Begin: m.Begin, Length: m.Length}
+
+	p.umu.Lock()
+	removed := false
+	for i, x := range p.uploads {
+		if x == req {
+			p.uploads = append(p.uploads[:i], p.uploads[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	p.umu.Unlock()
+
+	if removed {
+		return p.reject(req)
+	}
+	return nil
+}
+
+// nextUpload Saca el proximo pedido de la cola
+func (p *Peer) nextUpload() (blockRequest, bool) {
+	p.umu.Lock()
+	defer p.umu.Unlock()
+
+	if len(p.uploads) == 0 {
+		return blockRequest{}, false
+	}
+	req := p.uploads[0]
+	p.uploads = p.uploads[1:]
+	return req, true
+}
+
+// uploader GoRoutine que atiende los pedidos del par mientras la conexion este abierta
+func (p *Peer) uploader(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-p.uploadSignal:
+		}
+
+		for {
+			req, ok := p.nextUpload()
+			if !ok {
+				break
+			}
+
+			data, err := p.torrent.readBlock(int(req.Index), int64(req.Begin), int(req.Length))
+			if err != nil {
+				log.Printf("%21s- Could not read block %d:%d+%d: %s\n", p, req.Index, req.Begin, req.Length, err.Error())
+				continue
+			}
+
+			err = p.Send(&Message{ID: MsgPiece, Index: req.Index, Begin: req.Begin, Block: data})
+			if err != nil {
+				return
+			}
+
+			p.umu.Lock()
+			p.Uploaded += int64(len(data))
+			p.umu.Unlock()
+			p.torrent.addUploaded(len(data))
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package libgorrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// webSeedTimeout Tiempo maximo de cada pedido HTTP
+	webSeedTimeout = time.Minute
+
+	// webSeedIdle Cada cuanto volvemos a mirar si hay algo para pedir cuando no habia nada
+	webSeedIdle = 2 * time.Second
+
+	// webSeedMinBackoff Espera despues del primer error, se duplica con cada error seguido
+	webSeedMinBackoff = 5 * time.Second
+
+	// webSeedMaxBackoff La espera entre errores no pasa de esto
+	webSeedMaxBackoff = 5 * time.Minute
+
+	// webSeedMaxBadPieces Despues de tantas piezas que no pasan el hash dejamos de usar la web seed,
+	// seguramente tiene otra version de los archivos
+	webSeedMaxBadPieces = 5
+)
+
+// webSeed Una fuente HTTP de piezas, de url-list (BEP 19) o de httpseeds (BEP 17).
+// Para el picker es un par virtual que tiene todas las piezas.
+type webSeed struct {
+	URL string
+	// fetch Baja length bytes de la pieza index a partir de begin
+	fetch  func(t *Torrent, ws *webSeed, index int, begin, length int64) ([]byte, error)
+	peer   *Peer
+	client *http.Client
+}
+
+// webSeedRetry El seed nos pidio que volvamos a intentar despues de un tiempo
+type webSeedRetry struct {
+	after time.Duration
+}
+
+func (e *webSeedRetry) Error() string {
+	return "Seed busy, retrying in " + e.after.String()
+}
+
+// parseURLList Lee url-list (BEP 19), que puede ser una URL sola o una lista
+func parseURLList(v interface{}) []string {
+	var ret []string
+	switch list := v.(type) {
+	case string:
+		if list != "" {
+			ret = append(ret, list)
+		}
+	case []interface{}:
+		for _, u := range list {
+			if s, ok := u.(string); ok && s != "" {
+				ret = appendIfMissing(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+// newWebSeed Arma la web seed con su par virtual
+func newWebSeed(u string, fetch func(t *Torrent, ws *webSeed, index int, begin, length int64) ([]byte, error)) *webSeed {
+	p := &Peer{Choked: false, Interested: true}
+	p.Init()
+	return &webSeed{
+		URL:    u,
+		fetch:  fetch,
+		peer:   p,
+		client: &http.Client{Timeout: webSeedTimeout},
+	}
+}
+
+// startWebSeeds Arranca una GoRoutine por cada web seed del torrent, de los dos tipos
+func (t *Torrent) startWebSeeds() {
+	var seeds []*webSeed
+	for _, u := range t.File.URLList {
+		if !isHTTPURL(u) {
+			log.Println("Unsupported web seed " + u)
+			continue
+		}
+		seeds = append(seeds, newWebSeed(u, fetchURLSeed))
+	}
+	for _, u := range t.File.HTTPSeeds {
+		if !isHTTPURL(u) {
+			log.Println("Unsupported HTTP seed " + u)
+			continue
+		}
+		seeds = append(seeds, newWebSeed(u, fetchHTTPSeed))
+	}
+
+	t.mutexPieces.Lock()
+	t.webSeeds = seeds
+	t.mutexPieces.Unlock()
+	for _, ws := range seeds {
+		go t.webSeedLoop(ws)
+	}
+}
+
+func isHTTPURL(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// webSeedLoop GoRoutine que baja piezas de la web seed mientras el torrent este descargando
+func (t *Torrent) webSeedLoop(ws *webSeed) {
+	defer func() {
+		t.releaseRequests(ws.peer)
+		t.peerGone(ws.peer)
+	}()
+
+	backoff := webSeedMinBackoff
+	badPieces := 0
+	for t.status() == Started {
+		ready, done := t.webSeedReady(ws)
+		if done {
+			return
+		}
+		if !ready {
+			time.Sleep(webSeedIdle)
+			continue
+		}
+
+		reqs := t.nextRequests(ws.peer, ws.peer.Pieces, t.File.Info.PieceLength/blockSize+1)
+		if len(reqs) == 0 {
+			time.Sleep(webSeedIdle)
+			continue
+		}
+
+		if err := t.webSeedDownload(ws, reqs); err != nil {
+			log.Printf("Web seed %s: %s\n", ws.URL, err.Error())
+			t.releaseRequests(ws.peer)
+			if retry, ok := err.(*webSeedRetry); ok {
+				// El seed dijo cuanto esperar, no es un error. Con 0 no lo martillamos.
+				if retry.after < time.Second {
+					retry.after = time.Second
+				}
+				time.Sleep(retry.after)
+				continue
+			}
+			if err == errHashFailed {
+				if badPieces++; badPieces >= webSeedMaxBadPieces {
+					log.Printf("Web seed %s: too many bad pieces, not using it anymore\n", ws.URL)
+					return
+				}
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > webSeedMaxBackoff {
+				backoff = webSeedMaxBackoff
+			}
+			continue
+		}
+		backoff = webSeedMinBackoff
+	}
+}
+
+// webSeedReady Ya tenemos la metadata para pedirle piezas a la web seed. done es que no falta nada.
+// La primera vez suma la web seed al picker.
+func (t *Torrent) webSeedReady(ws *webSeed) (ready bool, done bool) {
+	t.mutexPieces.Lock()
+	defer t.mutexPieces.Unlock()
+
+	if !t.File.HasInfo() {
+		return false, false
+	}
+	if t.Left <= 0 {
+		return false, true
+	}
+	if ws.peer.Pieces == nil {
+		ws.peer.Pieces = fullBitfield(len(t.Bitmap))
+		t.picker.AddBitfield(ws.peer.Pieces)
+	}
+	return true, false
+}
+
+// webSeedDownload Baja los bloques pedidos agrupando los contiguos de la misma pieza en un solo pedido
+func (t *Torrent) webSeedDownload(ws *webSeed, reqs []blockRequest) error {
+	for len(reqs) > 0 {
+		// En endgame otro par pudo haber mandado el bloque antes, no lo bajamos de nuevo
+		t.mutexPieces.Lock()
+		_, pending := ws.peer.requests[reqs[0]]
+		t.mutexPieces.Unlock()
+		if !pending {
+			reqs = reqs[1:]
+			continue
+		}
+
+		n := 1
+		for n < len(reqs) && reqs[n].Index == reqs[0].Index && reqs[n].Begin == reqs[n-1].Begin+reqs[n-1].Length {
+			n++
+		}
+		first, last := reqs[0], reqs[n-1]
+		length := int64(last.Begin+last.Length) - int64(first.Begin)
+
+		data, err := ws.fetch(t, ws, int(first.Index), int64(first.Begin), length)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != length {
+			return errors.New("Short read from web seed")
+		}
+
+		for _, req := range reqs[:n] {
+			begin := req.Begin - first.Begin
+			if err := t.blockReceived(ws.peer, req.Index, req.Begin, data[begin:begin+req.Length]); err != nil {
+				return err
+			}
+		}
+		ws.peer.Downloaded += length
+		reqs = reqs[n:]
+	}
+	return nil
+}
+
+// fetchURLSeed Baja un rango de una web seed de url-list. El rango de la pieza se traduce a
+// los archivos que lo componen y se pide cada uno con un Range.
+func fetchURLSeed(t *Torrent, ws *webSeed, index int, begin, length int64) ([]byte, error) {
+	off := int64(index)*int64(t.File.Info.PieceLength) + begin
+
+	data := make([]byte, 0, length)
+	for _, seg := range locate(t.File.GetFiles(), off, length) {
+		req, err := http.NewRequest("GET", webSeedFileURL(ws.URL, t.File, seg.File), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.Offset, seg.Offset+seg.Length-1))
+
+		resp, err := ws.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := readRange(resp, seg.Offset, seg.Length)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.New(req.URL.String() + ": " + err.Error())
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// readRange Lee el rango de la respuesta. Si el servidor ignoro el Range y mando todo, salteamos hasta offset.
+func readRange(resp *http.Response, offset, length int64) ([]byte, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("HTTP status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// webSeedFileURL URL del archivo i. En los torrents de un archivo una URL terminada en / es un directorio
+// y se le agrega el nombre. En los de varios archivos es siempre el directorio que contiene a name.
+func webSeedFileURL(base string, tf *TorrentFile, i int) string {
+	if len(tf.Info.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(tf.Info.Name)
+		}
+		return base
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(tf.Info.Name)}
+	for _, p := range tf.Info.Files[i].RawPath {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// fetchHTTPSeed Baja un rango de un seed de httpseeds (BEP 17). Se pide por pieza con
+// info_hash, piece y ranges, que son offsets dentro de la pieza con el final incluido.
+// Si el seed esta ocupado contesta 503 con los segundos a esperar en el cuerpo.
+func fetchHTTPSeed(t *Torrent, ws *webSeed, index int, begin, length int64) ([]byte, error) {
+	query := "info_hash=" + url.QueryEscape(string(t.File.InfoHash)) +
+		"&piece=" + strconv.Itoa(index) +
+		fmt.Sprintf("&ranges=%d-%d", begin, begin+length-1)
+	u := ws.URL
+	if strings.Contains(u, "?") {
+		u += "&" + query
+	} else {
+		u += "?" + query
+	}
+
+	resp, err := ws.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+		seconds, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil || seconds < 0 {
+			return nil, errors.New("HTTP status 503 without a retry interval")
+		}
+		return nil, &webSeedRetry{after: time.Duration(seconds) * time.Second}
+	default:
+		return nil, errors.New("HTTP status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
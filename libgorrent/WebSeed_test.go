@@ -0,0 +1,136 @@
+package libgorrent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webSeedDir Escribe los archivos del torrent de testTorrentFile como los serviria una web seed
+func webSeedDir(t *testing.T, tf *TorrentFile, data []byte) string {
+	dir := t.TempDir()
+	var off int64
+	for _, f := range tf.GetFiles() {
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, data[off:off+f.Length], 0644); err != nil {
+			t.Fatal(err)
+		}
+		off += f.Length
+	}
+	return dir
+}
+
+// webSeedDownloads Arranca el torrent sin pares y espera a que la web seed lo baje entero
+func webSeedDownloads(t *testing.T, tf *TorrentFile, data []byte, wait time.Duration) {
+	s := testSession(22300)
+	tor, err := s.AddTorrent(tf, WithStorage(MemoryStorage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor.Start()
+	defer s.Close()
+
+	if !waitFor(wait, func() bool { return downloaded(tor, data) }) {
+		t.Fatalf("web seed download did not finish, %d bytes left", tor.Left)
+	}
+}
+
+func TestWebSeedRange(t *testing.T) {
+	tf, data := testTorrentFile(t, 300000, 32768)
+	files := http.FileServer(http.Dir(webSeedDir(t, tf, data)))
+	var ranged, full int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		} else {
+			atomic.AddInt32(&full, 1)
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// El primero no es HTTP, se ignora
+	tf.URLList = []string{"ftp://example.com/", srv.URL}
+	webSeedDownloads(t, tf, data, 10*time.Second)
+
+	if atomic.LoadInt32(&ranged) == 0 || atomic.LoadInt32(&full) != 0 {
+		t.Fatalf("%d ranged and %d full requests", ranged, full)
+	}
+}
+
+func TestWebSeedIgnoresRange(t *testing.T) {
+	tf, data := testTorrentFile(t, 300000, 32768)
+	dir := webSeedDir(t, tf, data)
+	// Un servidor que no entiende Range y siempre manda el archivo entero con 200
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(r.URL.Path, "/"))))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	tf.URLList = []string{srv.URL + "/"}
+	webSeedDownloads(t, tf, data, 10*time.Second)
+}
+
+func TestWebSeedFileURL(t *testing.T) {
+	tf := &TorrentFile{}
+	tf.Info.Name = "a b"
+	if got := webSeedFileURL("http://h/dir/", tf, 0); got != "http://h/dir/a%20b" {
+		t.Fatal(got)
+	}
+	if got := webSeedFileURL("http://h/file", tf, 0); got != "http://h/file" {
+		t.Fatal(got)
+	}
+
+	tf.Info.Files = []File{{Length: 1, RawPath: []string{"d", "c%"}}}
+	if got := webSeedFileURL("http://h/dir", tf, 0); got != "http://h/dir/a%20b/d/c%25" {
+		t.Fatal(got)
+	}
+}
+
+func TestHTTPSeedRetryAfter(t *testing.T) {
+	tf, data := testTorrentFile(t, 300000, 32768)
+	var requests, busy int32 = 0, 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		q := r.URL.Query()
+		if q.Get("id") != "7" || q.Get("info_hash") != string(tf.InfoHash) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&busy, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "1")
+			return
+		}
+
+		var piece, begin, end int
+		fmt.Sscanf(q.Get("piece"), "%d", &piece)
+		fmt.Sscanf(q.Get("ranges"), "%d-%d", &begin, &end)
+		off := piece * tf.Info.PieceLength
+		w.Write(data[off+begin : off+end+1])
+	}))
+	defer srv.Close()
+
+	tf.HTTPSeeds = []string{srv.URL + "/seed?id=7"}
+	start := time.Now()
+	webSeedDownloads(t, tf, data, 10*time.Second)
+
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("finished in %s without waiting for the 503", elapsed)
+	}
+	if atomic.LoadInt32(&requests) < 2 {
+		t.Fatal("the seed was not asked again after the 503")
+	}
+}